@@ -0,0 +1,221 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package abuse implements abuse reports of short links and moderation queue.
+// Reported links are saved in "report:queue" sorted set with a number of reports as a score,
+// last reports of a link are saved in "reports:<short>" list,
+// temporary "reporter:<client>:<short>" keys prevent repeated reports of clients.
+package abuse
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+const (
+	// maxComment is a maximum length of report's comment.
+	maxComment = 1000
+	// reporterTTL is a period (seconds) when repeated reports of a client are ignored.
+	reporterTTL = 30 * 24 * 3600
+)
+
+var (
+	// Reasons are allowed reasons of reports.
+	Reasons = []string{"phishing", "malware", "spam", "other"}
+	// now returns current time, it can be replaced in tests.
+	now = time.Now
+)
+
+// Report is an abuse report of a link.
+type Report struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Comment string    `json:"comment"`
+}
+
+// isValid checks the report's fields.
+func (r *Report) isValid() error {
+	for _, reason := range Reasons {
+		if r.Reason == reason {
+			if len(r.Comment) > maxComment {
+				return errors.New("too long comment")
+			}
+			return nil
+		}
+	}
+	return errors.New("unknown reason")
+}
+
+// Item is a reported link of moderation queue.
+type Item struct {
+	Link    *link.Link
+	Count   int
+	Reports []Report
+}
+
+// keys returns db keys of queue and link's reports.
+func keys(short string) (string, string, error) {
+	queueKey, err := conf.DbKey("report", "queue")
+	if err != nil {
+		return "", "", err
+	}
+	reportsKey, err := conf.DbKey("reports", short)
+	if err != nil {
+		return "", "", err
+	}
+	return queueKey, reportsKey, nil
+}
+
+// Add saves new report of the link from the client.
+// Repeated reports of the same client and reports of whitelisted links are ignored,
+// it returns false for them.
+func Add(c redis.Conn, cfg *conf.Cfg, short, client string, r *Report) (bool, error) {
+	r.Comment = strings.TrimSpace(r.Comment)
+	if err := r.isValid(); err != nil {
+		return false, err
+	}
+	l, err := link.Get(c, short)
+	if err != nil {
+		return false, err
+	}
+	if l.Whitelisted {
+		return false, nil
+	}
+	queueKey, reportsKey, err := keys(short)
+	if err != nil {
+		return false, err
+	}
+	// client identifier is a key's part, so it can be purged by privacy settings
+	reporterKey, err := conf.DbKey("reporter", client+":"+short)
+	if err != nil {
+		return false, err
+	}
+	_, err = redis.String(c.Do("SET", reporterKey, 1, "EX", cfg.ClientDataTTL(reporterTTL), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.Time = now().UTC()
+	value, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.Do("LPUSH", reportsKey, value)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.Do("LTRIM", reportsKey, 0, cfg.Reports.Keep-1)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.Do("ZINCRBY", queueKey, 1, short)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Queue returns reported links, the most reported ones first.
+// Deleted links are removed from the queue.
+func Queue(c redis.Conn) ([]Item, error) {
+	queueKey, err := conf.DbKey("report", "queue")
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Strings(c.Do("ZREVRANGE", queueKey, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Item, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		short := values[i]
+		l, err := link.Get(c, short)
+		if err == link.ErrNotFound {
+			if err = Dismiss(c, short); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		item := Item{Link: l}
+		item.Count, err = strconv.Atoi(values[i+1])
+		if err != nil {
+			return nil, err
+		}
+		item.Reports, err = reports(c, short)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// Reported checks the link is in the moderation queue.
+func Reported(c redis.Conn, short string) (bool, error) {
+	queueKey, _, err := keys(short)
+	if err != nil {
+		return false, err
+	}
+	_, err = redis.Int(c.Do("ZSCORE", queueKey, short))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reports returns saved reports of the link, newest first.
+func reports(c redis.Conn, short string) ([]Report, error) {
+	reportsKey, err := conf.DbKey("reports", short)
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.ByteSlices(c.Do("LRANGE", reportsKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Report, len(values))
+	for i, value := range values {
+		if err = json.Unmarshal(value, &result[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Dismiss removes the link and its reports from the moderation queue.
+func Dismiss(c redis.Conn, short string) error {
+	queueKey, reportsKey, err := keys(short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("ZREM", queueKey, short)
+	if err != nil {
+		return err
+	}
+	reporters, err := conf.DbKey("reporter", "*:"+short)
+	if err != nil {
+		return err
+	}
+	reporterKeys, err := redis.Values(c.Do("KEYS", reporters))
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("DEL", append(reporterKeys, reportsKey)...)
+	return err
+}
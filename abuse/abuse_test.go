@@ -0,0 +1,148 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package abuse
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestReports(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	cfg.Reports.Keep = 2
+	ts := time.Unix(1500000000, 0)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+
+	for _, short := range []string{"1", "2", "3"} {
+		l := &link.Link{Short: short, URL: "https://example.com/" + short, Created: ts}
+		if err := link.Save(c, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := link.Whitelist(c, "3"); err != nil {
+		t.Fatal(err)
+	}
+	items := []struct {
+		Short  string
+		Client string
+		Reason string
+		Added  bool
+		Err    bool
+	}{
+		{"1", "a", "phishing", true, false},
+		{"1", "a", "spam", false, false},
+		{"1", "b", "malware", true, false},
+		{"1", "c", "other", true, false},
+		{"2", "a", "spam", true, false},
+		{"2", "b", "unknown", false, true},
+		{"3", "a", "spam", false, false},
+		{"4", "a", "spam", false, true},
+	}
+	for i, item := range items {
+		ts = ts.Add(time.Second)
+		added, err := Add(c, cfg, item.Short, item.Client, &Report{Reason: item.Reason})
+		if (added != item.Added) || ((err != nil) != item.Err) {
+			t.Errorf("unexpected result [%d]: %v, %v", i, added, err)
+		}
+	}
+	if _, err := Add(c, cfg, "2", "c", &Report{Reason: "spam", Comment: strings.Repeat("a", maxComment+1)}); err == nil {
+		t.Error("too long comment is saved")
+	}
+	queue, err := Queue(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(queue) != 2) || (queue[0].Link.Short != "1") || (queue[0].Count != 3) || (queue[1].Count != 1) {
+		t.Fatalf("unexpected queue %v", queue)
+	}
+	reports := queue[0].Reports
+	if (len(reports) != 2) || (reports[0].Reason != "other") || (reports[1].Reason != "malware") {
+		t.Errorf("unexpected reports %v", reports)
+	}
+	if !reports[0].Time.Equal(ts.Add(-4 * time.Second)) {
+		t.Errorf("unexpected time %v", reports[0].Time)
+	}
+	ttl, err := redis.Int(c.Do("TTL", "reporter:a:1"))
+	if (err != nil) || (ttl < 1) || (ttl > reporterTTL) {
+		t.Errorf("unexpected reporter TTL %v: %v", ttl, err)
+	}
+	for short, expected := range map[string]bool{"1": true, "3": false} {
+		if reported, err := Reported(c, short); (err != nil) || (reported != expected) {
+			t.Errorf("unexpected reported %v of %v: %v", reported, short, err)
+		}
+	}
+	if err = Dismiss(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if reported, err := Reported(c, "1"); (err != nil) || reported {
+		t.Errorf("unexpected reported %v: %v", reported, err)
+	}
+	reporters, err := redis.Strings(c.Do("KEYS", "reporter:*"))
+	if (err != nil) || (len(reporters) != 1) || (reporters[0] != "reporter:a:2") {
+		t.Errorf("unexpected reporters %v: %v", reporters, err)
+	}
+	// client can report again after dismiss
+	if added, err := Add(c, cfg, "1", "a", &Report{Reason: "spam"}); !added || (err != nil) {
+		t.Errorf("unexpected result %v, %v", added, err)
+	}
+	if err = link.Delete(c, &link.Link{Short: "2", URL: "https://example.com/2"}); err != nil {
+		t.Fatal(err)
+	}
+	queue, err = Queue(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(queue) != 1) || (queue[0].Link.Short != "1") || (queue[0].Count != 1) {
+		t.Errorf("unexpected queue %v", queue)
+	}
+	n, err := c.Do("EXISTS", "reports:2")
+	if (err != nil) || (n.(int64) != 0) {
+		t.Errorf("reports of deleted link are not removed: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package access implements temporary bans of clients' networks.
+// Bans are saved in a sorted set where a score is an expiration time.
+package access
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/privacy"
+)
+
+var (
+	// now returns current time, it can be replaced in tests.
+	now = time.Now
+)
+
+// Ban is a banned network.
+type Ban struct {
+	Network string
+	// Expire is ban's expiration time, it's zero for permanent ban.
+	Expire time.Time
+}
+
+// Area is a group of routes with own access lists.
+type Area int
+
+// Areas of routes.
+const (
+	Public Area = iota
+	API
+	Admin
+)
+
+// RouteArea returns an area of the request path without leading slash.
+// Internal metrics of the main listener are in administration area.
+func RouteArea(path string) Area {
+	switch {
+	case (path == "admin") || strings.HasPrefix(path, "admin/") || (path == "metrics"):
+		return Admin
+	case (path == "api") || strings.HasPrefix(path, "api/"):
+		return API
+	}
+	return Public
+}
+
+// banKey returns db key of bans set.
+func banKey() (string, error) {
+	return conf.DbKey("ban", "list")
+}
+
+// Add bans the network for ttl, zero ttl is a permanent ban.
+// It returns normalized network value.
+func Add(c redis.Conn, network string, ttl time.Duration) (string, error) {
+	n, err := conf.ParseNetwork(network)
+	if err != nil {
+		return "", err
+	}
+	key, err := banKey()
+	if err != nil {
+		return "", err
+	}
+	var score interface{} = "+inf"
+	if ttl > 0 {
+		score = now().Add(ttl).Unix()
+	}
+	_, err = c.Do("ZADD", key, score, n.String())
+	if err != nil {
+		return "", err
+	}
+	return n.String(), nil
+}
+
+// Remove unbans the network.
+func Remove(c redis.Conn, network string) error {
+	key, err := banKey()
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("ZREM", key, network)
+	return err
+}
+
+// List returns active bans, expired ones are removed.
+func List(c redis.Conn) ([]Ban, error) {
+	key, err := banKey()
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.Do("ZREMRANGEBYSCORE", key, "-inf", fmt.Sprintf("(%d", now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Strings(c.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Ban, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		b := Ban{Network: values[i]}
+		expire, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		if !math.IsInf(expire, 1) {
+			b.Expire = time.Unix(int64(expire), 0).UTC()
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// IsBanned checks the IP address belongs to an active banned network.
+func IsBanned(c redis.Conn, ip net.IP) (bool, error) {
+	key, err := banKey()
+	if err != nil {
+		return false, err
+	}
+	values, err := redis.Strings(c.Do("ZRANGEBYSCORE", key, now().Unix(), "+inf"))
+	if err != nil {
+		return false, err
+	}
+	for _, value := range values {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return false, err
+		}
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check verifies that request's client can use a route with the path.
+// Administration and API routes use configured allow and deny lists,
+// banned networks don't have access to all routes except administration ones.
+func Check(c redis.Conn, cfg *conf.Cfg, path string, r *http.Request) (bool, error) {
+	ip := privacy.ClientIP(cfg, r)
+	if ip == nil {
+		return false, nil
+	}
+	switch RouteArea(path) {
+	case Admin:
+		return cfg.Access.Admin.Permits(ip), nil
+	case API:
+		if !cfg.Access.API.Permits(ip) {
+			return false, nil
+		}
+	}
+	banned, err := IsBanned(c, ip)
+	if err != nil {
+		return false, err
+	}
+	return !banned, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package access
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestRouteArea(t *testing.T) {
+	items := map[string]Area{
+		"":            Public,
+		"abc":         Public,
+		"administer":  Public,
+		"admin":       Admin,
+		"admin/login": Admin,
+		"metrics":     Admin,
+		"metricsabc":  Public,
+		"api/add":     API,
+		"apiary":      Public,
+	}
+	for path, expected := range items {
+		if a := RouteArea(path); a != expected {
+			t.Errorf("unexpected area of %q: %v", path, a)
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	ts := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+
+	if _, err := Add(c, "bad", time.Hour); err == nil {
+		t.Error("invalid network is banned")
+	}
+	network, err := Add(c, "2001:db8:1:2:3::1/64", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network != "2001:db8:1:2::/64" {
+		t.Errorf("unexpected network %v", network)
+	}
+	if _, err = Add(c, "192.0.2.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	items := map[string]bool{
+		"2001:db8:1:2:ffff::1": true,
+		"2001:db8:1:3::1":      false,
+		"192.0.2.1":            true,
+		"192.0.2.2":            false,
+	}
+	for value, expected := range items {
+		banned, err := IsBanned(c, net.ParseIP(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if banned != expected {
+			t.Errorf("unexpected ban result for %v", value)
+		}
+	}
+	bans, err := List(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(bans) != 2) || !bans[0].Expire.Equal(ts.Add(time.Hour)) || !bans[1].Expire.IsZero() {
+		t.Errorf("unexpected bans %v", bans)
+	}
+	// expired ban
+	now = func() time.Time { return ts.Add(2 * time.Hour) }
+	if banned, err := IsBanned(c, net.ParseIP("2001:db8:1:2::1")); err != nil || banned {
+		t.Errorf("expired ban is active: %v", err)
+	}
+	bans, err = List(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(bans) != 1) || (bans[0].Network != "192.0.2.1/32") {
+		t.Errorf("unexpected bans %v", bans)
+	}
+	r := httptest.NewRequest("GET", "/abc", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	for path, expected := range map[string]bool{"abc": false, "api/add": false, "admin/login": true} {
+		allowed, err := Check(c, cfg, path, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != expected {
+			t.Errorf("unexpected access to %v", path)
+		}
+	}
+	if err = Remove(c, "192.0.2.1/32"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, err := Check(c, cfg, "abc", r); (err != nil) || !allowed {
+		t.Errorf("unban failed: %v", err)
+	}
+}
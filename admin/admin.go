@@ -10,21 +10,32 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/analytics"
+	"github.com/z0rr0/lruss/apikey"
+	"github.com/z0rr0/lruss/audit"
 	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+	"github.com/z0rr0/lruss/policy"
+	"github.com/z0rr0/lruss/privacy"
+	"github.com/z0rr0/lruss/rules"
 	"github.com/z0rr0/lruss/trim"
+	"github.com/z0rr0/lruss/webhook"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -46,27 +57,123 @@ const (
 	sessionLen = 128
 	// passLen is admin user password length (bytes)
 	passLen = 12
+	// defaultWindow is default statistics period (days).
+	defaultWindow = 7
+	// pageSize is a number of links per page.
+	pageSize = 50
+)
+
+var (
+	// statsWindows are available statistics periods (days).
+	statsWindows = []int{1, 7, 30, 90}
+	// linkMessages are success alerts of links changes.
+	linkMessages = map[string]string{
+		"updated": "link %v is updated",
+		"deleted": "link %v is deleted",
+		"enabled": "link %v is enabled",
+	}
 )
 
 // key is internal context key.
 type key string
 
+// message returns a success alert by a request parameter which name is found in formats,
+// the parameter's value is inserted into the fixed format, e.g. "updated=abc".
+func message(r *http.Request, formats map[string]string) string {
+	for name, format := range formats {
+		if value := r.FormValue(name); value != "" {
+			return fmt.Sprintf(format, value)
+		}
+	}
+	return ""
+}
+
 // loginForm is login page form data struct.
 type loginForm struct {
 	User     string
 	Password string
 	Msg      string
 	CSRF     string
+	Token    string
 	Failed   bool
 }
 
+// passwordForm is password change page data.
+type passwordForm struct {
+	CSRF      string
+	Msg       string
+	Error     string
+	MinLength int
+	Classes   int
+}
+
+// dashboard is analytics data of administration page.
+type dashboard struct {
+	Days      []analytics.Day  `json:"days"`
+	Top       []analytics.Item `json:"top"`
+	Referrers []analytics.Item `json:"referrers"`
+	Campaigns []analytics.Item `json:"campaigns"`
+}
+
 // statistics is administration statistics struct.
 type statistics struct {
-	LastNum  int64
-	LastURL  string
-	Sessions string
+	LastNum   int64
+	LastURL   string
+	Sessions  int
+	CSRF      string
+	Msg       string
+	Locks     []lockInfo
+	Window    int
+	Windows   []int
+	Dashboard *dashboard
+}
+
+// hooksInfo is webhooks administration page data.
+type hooksInfo struct {
+	CSRF          string
+	Msg           string
+	Active        bool
+	Subscriptions map[string][]string
+	Deliveries    []webhook.Status
+	Dead          int
+}
+
+// linksInfo is links administration page data.
+type linksInfo struct {
+	CSRF   string
+	Msg    string
+	Site   string
+	Query  string
+	All    bool
+	Admin  bool
+	Editor bool
+	Owner  string
+	Links  []link.Link
+	Page   int
+	Pages  []int
+}
+
+// linkInfo is link's options page data.
+type linkInfo struct {
 	CSRF     string
-	Locks    []string
+	Msg      string
+	Error    string
+	Site     string
+	Link     *link.Link
+	Statuses []int
+	Policies []string
+	Rules    string
+	Devices  []string
+	Max      int
+}
+
+// keysInfo is API keys administration page data.
+type keysInfo struct {
+	CSRF  string
+	Msg   string
+	Error string
+	Token string
+	Keys  []apikey.Key
 }
 
 type shortURLs []string
@@ -79,6 +186,44 @@ func (s shortURLs) Less(i, j int) bool {
 	return di < dj
 }
 
+// statsWindow returns statistics period from request parameter "days".
+func statsWindow(r *http.Request) int {
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil {
+		return defaultWindow
+	}
+	for _, w := range statsWindows {
+		if days == w {
+			return days
+		}
+	}
+	return defaultWindow
+}
+
+// loadDashboard reads analytics data of last days.
+func loadDashboard(c redis.Conn, cfg *conf.Cfg, days int) (*dashboard, error) {
+	daily, err := analytics.Daily(c, days)
+	if err != nil {
+		return nil, err
+	}
+	top, err := analytics.TopLinks(c, days, cfg.Analytics.TopSize)
+	if err != nil {
+		return nil, err
+	}
+	for i := range top {
+		top[i].Name = cfg.ShortURL(top[i].Name)
+	}
+	referrers, err := analytics.TopReferrers(c, days, cfg.Analytics.TopSize)
+	if err != nil {
+		return nil, err
+	}
+	campaigns, err := analytics.TopCampaigns(c, days, cfg.Analytics.TopSize)
+	if err != nil {
+		return nil, err
+	}
+	return &dashboard{Days: daily, Top: top, Referrers: referrers, Campaigns: campaigns}, nil
+}
+
 // SetContext writes settings to context.
 func SetContext(ctx context.Context, username string) context.Context {
 	return context.WithValue(ctx, userKey, username)
@@ -162,100 +307,135 @@ func CheckCSRF(ctx context.Context, token string) (bool, error) {
 // Auth checks user's authentication and saves username to the ctx context.
 // Session cookie is to be have s value like "username::xxxxx".
 func Auth(ctx context.Context, r *http.Request) (context.Context, error) {
-	cookie, err := r.Cookie(SessionCookie)
-	if err != nil {
+	if _, err := r.Cookie(SessionCookie); err != nil {
 		return SetContext(ctx, Anonymous), err
 	}
 	cfg, err := conf.GetContext(ctx)
 	if err != nil {
 		return ctx, err
 	}
-	// expected: values[0] is username, values[1] is session key
-	values := strings.SplitN(cookie.Value, "::", 2)
-	if len(values) < 2 {
-		return ctx, errors.New("invalid cookie value")
+	username, id, err := readSession(r)
+	if err != nil {
+		return ctx, err
 	}
 	c := cfg.GetConn()
 	defer c.Close()
-	sessionKey, err := conf.DbKey("session", values[0])
+	err = checkSession(c, cfg, username, id)
 	if err != nil {
 		return ctx, err
 	}
-	found, err := redis.Int(c.Do("SISMEMBER", sessionKey, values[1]))
+	role, err := userRole(c, username)
 	if err != nil {
 		return ctx, err
 	}
-	if found == 0 {
-		return ctx, errors.New("invalid session key")
-	}
-	return SetContext(ctx, values[0]), nil
+	return SetRoleContext(SetContext(ctx, username), role), nil
 }
 
-// setSession generates and sets new session key, after that creates s new session cookie.
-func setSession(w http.ResponseWriter, c redis.Conn, secure bool, username string) error {
-	sessionKey, err := conf.DbKey("session", username)
+// CreateOrUpdate creates new user/password pair or updates s current user if it already exists.
+// A random password is generated if password is empty, otherwise it should satisfy passwords policy.
+func CreateOrUpdate(cfg *conf.Cfg, username, password string) (string, bool, error) {
+	c := cfg.GetConn()
+	defer c.Close()
+
+	usernameKey, err := conf.DbKey("user", username)
 	if err != nil {
-		return err
+		return "", false, err
+	}
+	var hash string
+	if password == "" {
+		password, hash, err = newPassword(cfg)
+	} else {
+		hash, err = hashPassword(cfg, password)
 	}
-	b := make([]byte, sessionLen)
-	_, err = rand.Read(b)
 	if err != nil {
-		return err
+		return "", false, err
 	}
-	value := base64.StdEncoding.EncodeToString(b)
-	_, err = c.Do("SADD", sessionKey, value)
+	created, err := redis.Int(c.Do("HSET", usernameKey, "password", hash))
 	if err != nil {
-		return err
+		return "", false, err
 	}
-	cookie := http.Cookie{
-		Name:     SessionCookie,
-		Value:    fmt.Sprintf("%v::%v", username, value),
-		MaxAge:   0,
-		HttpOnly: true,
-		Path:     "/",
-		Secure:   secure,
+	return password, created == 1, nil
+}
+
+// hashPassword checks the password by passwords policy and returns its hash.
+func hashPassword(cfg *conf.Cfg, password string) (string, error) {
+	err := cfg.Password.Check(password)
+	if err != nil {
+		return "", err
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), cfg.Password.Cost)
+	if err != nil {
+		return "", err
 	}
-	http.SetCookie(w, &cookie)
-	return nil
+	return hex.EncodeToString(h), nil
 }
 
-// CreateOrUpdate creates new user/password pair or updates s current user if it already exists.
-func CreateOrUpdate(cfg *conf.Cfg, username string) (string, bool, error) {
-	c := cfg.GetConn()
-	defer c.Close()
+// newPassword generates a random password, it returns the password and its hash.
+func newPassword(cfg *conf.Cfg) (string, string, error) {
+	b := make([]byte, passLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	password := hex.EncodeToString(b)
+	h, err := bcrypt.GenerateFromPassword([]byte(password), cfg.Password.Cost)
+	if err != nil {
+		return "", "", err
+	}
+	return password, hex.EncodeToString(h), nil
+}
 
+// createUser creates new user with the role and returns its password.
+func createUser(c redis.Conn, cfg *conf.Cfg, username string, role Role) (string, error) {
 	usernameKey, err := conf.DbKey("user", username)
 	if err != nil {
-		return "", false, err
+		return "", err
 	}
-	b := make([]byte, passLen)
-	_, err = rand.Read(b)
+	password, hash, err := newPassword(cfg)
 	if err != nil {
-		return "", false, err
+		return "", err
 	}
-	h, err := bcrypt.GenerateFromPassword(b, bcrypt.DefaultCost)
+	created, err := redis.Int(c.Do("HSETNX", usernameKey, "password", hash))
 	if err != nil {
-		return "", false, err
+		return "", err
+	}
+	if created == 0 {
+		return "", fmt.Errorf("user %q already exists", username)
 	}
-	created, err := redis.Int(c.Do("HSET", usernameKey, "password", hex.EncodeToString(h)))
+	err = SetRole(c, username, role)
 	if err != nil {
-		return "", false, err
+		return "", err
 	}
-	return hex.EncodeToString(b), created == 1, nil
+	return password, nil
 }
 
-// CheckPassword verifies s password of user with name username.
-func CheckPassword(c redis.Conn, username, password string) error {
+// SetPassword changes a password of existing user.
+func SetPassword(c redis.Conn, cfg *conf.Cfg, username, password string) error {
 	usernameKey, err := conf.DbKey("user", username)
 	if err != nil {
 		return err
 	}
-	b, err := hex.DecodeString(password)
+	hash, err := hashPassword(cfg, password)
+	if err != nil {
+		return err
+	}
+	_, err = redis.String(c.Do("HGET", usernameKey, "password"))
+	if err == redis.ErrNil {
+		return fmt.Errorf("unknown user %q", username)
+	}
 	if err != nil {
 		return err
 	}
-	if len(b) != passLen {
-		return errors.New("too short password")
+	_, err = c.Do("HSET", usernameKey, "password", hash)
+	return err
+}
+
+// CheckPassword verifies s password of user with name username.
+// Old generated passwords were hashed as decoded bytes, they are still valid.
+func CheckPassword(c redis.Conn, username, password string) error {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return err
 	}
 	hash, err := redis.String(c.Do("HGET", usernameKey, "password"))
 	if err != nil {
@@ -265,9 +445,135 @@ func CheckPassword(c redis.Conn, username, password string) error {
 	if err != nil {
 		return err
 	}
+	err = bcrypt.CompareHashAndPassword(h, []byte(password))
+	if err != bcrypt.ErrMismatchedHashAndPassword {
+		return err
+	}
+	b, e := hex.DecodeString(password)
+	if (e != nil) || (len(b) != passLen) {
+		return err
+	}
 	return bcrypt.CompareHashAndPassword(h, b)
 }
 
+// ChangePassword shows password change form and updates the password of current user.
+// Other sessions of the user are finished after the change.
+func ChangePassword(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	username := GetContext(ctx)
+	data := &passwordForm{
+		CSRF:      csrfValue,
+		MinLength: cfg.Password.MinLength,
+		Classes:   cfg.Password.Classes,
+	}
+	if r.Method == "POST" {
+		// csrf is already checked
+		c := cfg.GetConn()
+		defer c.Close()
+
+		password := r.PostFormValue("password")
+		switch {
+		case CheckPassword(c, username, r.PostFormValue("current")) != nil:
+			data.Error = "invalid current password"
+		case password != r.PostFormValue("confirm"):
+			data.Error = "passwords mismatch"
+		default:
+			err = SetPassword(c, cfg, username, password)
+			if err != nil {
+				data.Error = err.Error()
+				break
+			}
+			_, current, err := readSession(r)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			err = revokeSessions(c, username, current)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			data.Msg = "password is changed, other sessions are finished"
+			audit.Annotate(ctx, "password.change", "user:"+username)
+		}
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_password.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// authenticate checks login form values. It returns authenticated username
+// or a token of second login step if two-factor authentication is enabled for the user.
+// The token is also returned with an error when the code should be entered again.
+// Failed attempts are counted per username and client.
+func authenticate(c redis.Conn, cfg *conf.Cfg, r *http.Request) (string, string, error) {
+	ip := privacy.RemoteIP(cfg, r)
+	client, err := loginClient(c, cfg, r)
+	if err != nil {
+		return "", "", err
+	}
+	if token := r.PostFormValue("token"); token != "" {
+		username, err := finishLogin(c, cfg, token, r.PostFormValue("code"))
+		if err == errInvalidCode {
+			if e := loginFailed(c, cfg, username, client, ip); e != nil {
+				return "", "", e
+			}
+			return "", token, err
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if _, err = userRole(c, username); err != nil {
+			return "", "", errMismatch
+		}
+		return username, "", loginSucceeded(c, username)
+	}
+	username := r.PostFormValue("user")
+	wait, err := loginLock(c, username, client)
+	if err != nil {
+		return "", "", err
+	}
+	if wait > 0 {
+		return "", "", &lockError{wait}
+	}
+	err = CheckPassword(c, username, r.PostFormValue("password"))
+	if err == nil {
+		_, err = userRole(c, username)
+	}
+	if err != nil {
+		if e := loginFailed(c, cfg, username, client, ip); e != nil {
+			return "", "", e
+		}
+		return "", "", errMismatch
+	}
+	secret, err := totpSecret(c, username)
+	if err != nil {
+		return "", "", err
+	}
+	if secret == "" {
+		return username, "", loginSucceeded(c, username)
+	}
+	token, err := startLogin(c, username)
+	if err != nil {
+		return "", "", err
+	}
+	return "", token, nil
+}
+
 // renderLogin prepares login page template.
 func renderLogin(w http.ResponseWriter, f *loginForm, static string) error {
 	tpl, err := template.ParseFiles(
@@ -303,21 +609,37 @@ func Login(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, er
 		c := cfg.GetConn()
 		defer c.Close()
 
-		err = CheckPassword(c, form.User, form.Password)
-		if err == nil {
-			// authenticated
-			secure, err := cfg.IsSecure()
+		username, token, err := authenticate(c, cfg, r)
+		if lockErr, ok := err.(*lockError); ok {
+			form.Msg = err.Error()
+			audit.Annotate(ctx, "login.locked", "user:"+form.User)
+			w.Header().Set("Retry-After", fmt.Sprint(lockErr.wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			err = renderLogin(w, form, cfg.Static)
 			if err != nil {
 				return http.StatusInternalServerError, err
 			}
-			err = setSession(w, c, secure, form.User)
+			return http.StatusTooManyRequests, nil
+		}
+		switch {
+		case err != nil:
+			form.Token, form.Msg = token, err.Error()
+			audit.Annotate(ctx, "login.failed", "user:"+form.User)
+		case token != "":
+			// password is valid, second factor is required
+			form.Token = token
+			audit.Annotate(ctx, "login.password", "user:"+form.User)
+		default:
+			// authenticated
+			audit.SetActor(ctx, username)
+			audit.Annotate(ctx, "login", "user:"+username)
+			err = setSession(w, r, c, cfg, username)
 			if err != nil {
 				return http.StatusInternalServerError, err
 			}
 			http.Redirect(w, r, "/admin/index/", http.StatusFound)
 			return http.StatusFound, nil
 		}
-		form.Msg = "mismatch user or password"
 	}
 	err = renderLogin(w, form, cfg.Static)
 	if err != nil {
@@ -341,23 +663,15 @@ func Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, e
 	c := cfg.GetConn()
 	defer c.Close()
 
-	cookie, err := r.Cookie(SessionCookie)
+	_, id, err := readSession(r)
 	if err != nil {
 		// impossible case
 		http.Redirect(w, r, "/", http.StatusFound)
 		return http.StatusFound, nil
 	}
-	values := strings.SplitN(cookie.Value, "::", 2)
-	if len(values) < 2 {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return http.StatusFound, nil
-	}
-	sessionKey, err := conf.DbKey("session", username)
-	if err != nil {
-		return http.StatusInternalServerError, err
-	}
 	// remove session from db
-	_, err = c.Do("SREM", sessionKey, values[1])
+	audit.Annotate(ctx, "logout", "user:"+username)
+	err = revokeSession(c, username, id)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -366,7 +680,7 @@ func Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, e
 		return http.StatusInternalServerError, err
 	}
 	// remove session cookie
-	cookie = &http.Cookie{
+	cookie := &http.Cookie{
 		Name:     SessionCookie,
 		Value:    "",
 		MaxAge:   -1,
@@ -390,6 +704,12 @@ func Index(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, er
 		return http.StatusInternalServerError, err
 	}
 	data := statistics{CSRF: csrfValue}
+	if purged := r.FormValue("purged"); purged != "" {
+		data.Msg = fmt.Sprintf("deleted records: %v", purged)
+	}
+	if unlocked := r.FormValue("unlocked"); unlocked != "" {
+		data.Msg = fmt.Sprintf("lock %v is removed", unlocked)
+	}
 	c := cfg.GetConn()
 	defer c.Close()
 
@@ -405,49 +725,496 @@ func Index(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, er
 	short := trim.Encode(n)
 	data.LastNum, data.LastURL = n, cfg.ShortURL(short)
 
-	// sessions
-	dbKey, err = conf.DbKey("session", "*")
+	// own sessions
+	_, current, err := readSession(r)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	keys, err := redis.Strings(c.Do("KEYS", dbKey))
+	own, err := userSessions(c, GetContext(ctx), current)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	sessions := make([]string, len(keys))
-	for i, key := range keys {
-		user := key[len(dbKey)-1:]
-		s, err := redis.Strings(c.Do("SMEMBERS", key))
+	data.Sessions = len(own)
+
+	// locks
+	data.Locks, err = activeLocks(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// analytics
+	if cfg.Analytics.Active {
+		data.Window, data.Windows = statsWindow(r), statsWindows
+		data.Dashboard, err = loadDashboard(c, cfg, data.Window)
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
-		sessions[i] = fmt.Sprintf("%v (%d)", user, len(s))
 	}
-	data.Sessions = strings.Join(sessions, ", ")
 
-	// locks
-	dbKey, err = conf.DbKey("host", "*")
+	// render template
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_index.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// Stats returns JSON analytics data for administration page charts.
+func Stats(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	keys, err = redis.Strings(c.Do("KEYS", dbKey))
+	if !cfg.Analytics.Active {
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	data, err := loadDashboard(c, cfg, statsWindow(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(data); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// Purge removes all stored data of a client by its IP address.
+func Purge(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	locks := make([]string, len(keys))
-	for i, key := range keys {
-		ttl, err := redis.Int(c.Do("TTL", key))
+	host := strings.TrimSpace(r.PostFormValue("ip"))
+	// purged address is not saved in the permanent audit log
+	audit.Annotate(ctx, "privacy.purge", "")
+	if net.ParseIP(host) == nil {
+		return http.StatusBadRequest, errors.New("invalid IP address")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	n, err := privacy.Purge(c, cfg, host)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/index/?purged=%d", n), http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// Webhooks returns webhooks delivery status page.
+func Webhooks(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &hooksInfo{
+		CSRF:          csrfValue,
+		Active:        cfg.Webhooks.Active,
+		Subscriptions: make(map[string][]string),
+	}
+	if requeued := r.FormValue("requeued"); requeued != "" {
+		data.Msg = fmt.Sprintf("requeued deliveries: %v", requeued)
+	}
+	for _, s := range cfg.Webhooks.Subscriptions {
+		data.Subscriptions[s.URL] = s.Events
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	data.Deliveries, err = webhook.Deliveries(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data.Dead, err = webhook.Dead(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_webhooks.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// RequeueWebhooks moves failed webhooks deliveries back to the queue.
+func RequeueWebhooks(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	audit.Annotate(ctx, "webhook.requeue", "")
+	n, err := webhook.Requeue(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/?requeued=%d", n), http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// Links returns a page of user's links, all links are shown if parameter "all" is set.
+// Parameter "q" is a search query.
+func Links(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &linksInfo{
+		CSRF:   csrfValue,
+		Msg:    message(r, linkMessages),
+		Site:   cfg.Site,
+		Query:  strings.TrimSpace(r.FormValue("q")),
+		All:    r.FormValue("all") != "",
+		Admin:  HasRole(ctx, RoleAdmin),
+		Editor: HasRole(ctx, RoleEditor),
+	}
+	// only administrators can see all links
+	data.All = data.All && data.Admin
+	data.Owner = link.UserOwner(GetContext(ctx))
+	owner := data.Owner
+	if data.All {
+		owner = ""
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	items, err := link.List(c, owner, data.Query)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	pages := (len(items) + pageSize - 1) / pageSize
+	data.Page, err = strconv.Atoi(r.FormValue("page"))
+	if (err != nil) || (data.Page < 1) || (data.Page > pages) {
+		data.Page = 1
+	}
+	for i := 1; i <= pages; i++ {
+		data.Pages = append(data.Pages, i)
+	}
+	start := (data.Page - 1) * pageSize
+	end := start + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	data.Links = items[start:end]
+
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_links.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// formLink returns a link by short code from POST parameter "short".
+func formLink(c redis.Conn, r *http.Request) (*link.Link, int, error) {
+	short := r.PostFormValue("short")
+	if !trim.IsShort(short) {
+		return nil, http.StatusBadRequest, errors.New("invalid short link")
+	}
+	l, err := link.Get(c, short)
+	if err == link.ErrNotFound {
+		code, err := conf.HTTPError(http.StatusNotFound)
+		return nil, code, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return l, http.StatusOK, nil
+}
+
+// EditLink changes destination URL of a link.
+func EditLink(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	u, err := policy.Check(cfg, r.PostFormValue("url"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	audit.Annotate(ctx, "link.update", r.PostFormValue("short"))
+	l, code, err := formLink(c, r)
+	if err != nil {
+		return code, err
+	}
+	if !canManage(ctx, l) {
+		return conf.HTTPError(http.StatusForbidden)
+	}
+	err = link.Update(c, l.Short, u.String())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, "/admin/links/?updated="+url.QueryEscape(l.Short), http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// LinkOptions returns redirect settings page of a link, POST request changes them.
+func LinkOptions(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	short := r.FormValue("short")
+	if !trim.IsShort(short) {
+		return http.StatusBadRequest, errors.New("invalid short link")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	l, err := link.Get(c, short)
+	if err == link.ErrNotFound {
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !canManage(ctx, l) {
+		return conf.HTTPError(http.StatusForbidden)
+	}
+	data := &linkInfo{
+		CSRF:     csrfValue,
+		Site:     cfg.Site,
+		Link:     l,
+		Statuses: []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect},
+		Policies: conf.ReferrerPolicies,
+	}
+	if r.Method == "POST" {
+		// csrf is already checked
+		audit.Annotate(ctx, "link.options", short)
+		o := link.Options{
+			Interstitial:   r.PostFormValue("interstitial"),
+			ReferrerPolicy: r.PostFormValue("referrer"),
+			PassQuery:      r.PostFormValue("pass_query") != "",
+			PassPath:       r.PostFormValue("pass_path") != "",
+		}
+		if value := r.PostFormValue("status"); value != "" {
+			o.Status, err = strconv.Atoi(value)
+		}
+		if err == nil {
+			err = link.SetOptions(c, short, &o)
+		}
 		if err != nil {
-			return http.StatusInternalServerError, err
+			data.Error = err.Error()
+		} else {
+			l.Options = o
+			data.Msg = "options are saved"
+		}
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_link.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// LinkRules returns conditional redirect rules page of a link, POST request changes them.
+func LinkRules(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !cfg.Rules.Active {
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	short := r.FormValue("short")
+	if !trim.IsShort(short) {
+		return http.StatusBadRequest, errors.New("invalid short link")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	l, err := link.Get(c, short)
+	if err == link.ErrNotFound {
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !canManage(ctx, l) {
+		return conf.HTTPError(http.StatusForbidden)
+	}
+	items, err := rules.Get(c, short)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &linkInfo{
+		CSRF:    csrfValue,
+		Site:    cfg.Site,
+		Link:    l,
+		Rules:   rules.Format(items),
+		Devices: rules.Devices,
+		Max:     cfg.Rules.Max,
+	}
+	if r.Method == "POST" {
+		// csrf is already checked
+		audit.Annotate(ctx, "link.rules", short)
+		data.Rules = r.PostFormValue("rules")
+		items, err = rules.Parse(data.Rules)
+		if err == nil {
+			err = rules.Set(c, cfg, short, items)
 		}
-		locks[i] = fmt.Sprintf("[%v sec.] %v", ttl, key[len(dbKey)-1:])
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Rules = rules.Format(items)
+			data.Msg = "rules are saved"
+		}
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_rules.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
-	data.Locks = locks
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
 
-	// render template
+// DeleteLink removes a link.
+func DeleteLink(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	audit.Annotate(ctx, "link.delete", r.PostFormValue("short"))
+	l, code, err := formLink(c, r)
+	if err != nil {
+		return code, err
+	}
+	if !canManage(ctx, l) {
+		return conf.HTTPError(http.StatusForbidden)
+	}
+	err = link.Delete(c, l)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, "/admin/links/?deleted="+url.QueryEscape(l.Short), http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// EnableLink removes disabled mark of a link, e.g. after false positive blocklist match.
+func EnableLink(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	audit.Annotate(ctx, "link.enable", r.PostFormValue("short"))
+	l, code, err := formLink(c, r)
+	if err != nil {
+		return code, err
+	}
+	err = link.Enable(c, l.Short)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, "/admin/links/?enabled="+url.QueryEscape(l.Short), http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// Keys returns API keys page and creates new key by POST request.
+func Keys(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &keysInfo{CSRF: csrfValue}
+	if revoked := r.FormValue("revoked"); revoked != "" {
+		data.Msg = fmt.Sprintf("API key '%v' is revoked", revoked)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if r.Method == "POST" {
+		// csrf is already checked
+		name := strings.TrimSpace(r.PostFormValue("name"))
+		rate, errRate := strconv.ParseInt(r.PostFormValue("rate"), 10, 64)
+		quota, errQuota := strconv.ParseInt(r.PostFormValue("quota"), 10, 64)
+		if (errRate != nil) || (errQuota != nil) {
+			data.Error = "invalid rate or quota value"
+		} else {
+			data.Token, err = apikey.Create(c, name, rate, quota)
+			if err != nil {
+				data.Error = err.Error()
+			} else {
+				data.Msg = fmt.Sprintf("API key '%v' is created, copy its value, it is shown only once", name)
+				audit.Annotate(ctx, "apikey.create", name)
+			}
+		}
+	}
+	data.Keys, err = apikey.List(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
 	tpl, err := template.ParseFiles(
 		filepath.Join(cfg.Static, "base.html"),
-		filepath.Join(cfg.Static, "admin_index.html"),
+		filepath.Join(cfg.Static, "admin_keys.html"),
 	)
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -459,7 +1226,29 @@ func Index(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, er
 	return http.StatusOK, nil
 }
 
-// Export returns CSV data of all handled URLs.
+// RevokeKey revokes API key by its name.
+func RevokeKey(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	name := r.PostFormValue("name")
+	audit.Annotate(ctx, "apikey.revoke", name)
+	if !apikey.IsValidName(name) {
+		return http.StatusBadRequest, errors.New("invalid API key name")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	err = apikey.Revoke(c, name)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, "/admin/keys/?revoked="+name, http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// Export returns CSV data of handled URLs, editors get only own links.
 func Export(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
 	const layout = "20060102_150405"
 
@@ -478,6 +1267,7 @@ func Export(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, e
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	audit.Annotate(ctx, "link.export", "")
 	sort.Sort(shortURLs(keys))
 	w.Header().Set(
 		"Content-disposition",
@@ -489,12 +1279,30 @@ func Export(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, e
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	all := HasRole(ctx, RoleAdmin)
 	for _, key := range keys {
+		short := key[urlPrefix:]
+		if !all {
+			l, err := link.Get(c, short)
+			if err == link.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if !canManage(ctx, l) {
+				continue
+			}
+		}
 		originURL, err := redis.String(c.Do("GET", key))
+		if err == redis.ErrNil {
+			// the link is deleted during export
+			continue
+		}
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
-		err = wCSV.Write([]string{cfg.ShortURL(key[urlPrefix:]), originURL})
+		err = wCSV.Write([]string{cfg.ShortURL(short), originURL})
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
@@ -6,12 +6,20 @@ package admin
 
 import (
 	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/z0rr0/lruss/audit"
 	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+	"github.com/z0rr0/lruss/totp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -94,6 +102,393 @@ func TestCheckCSRF(t *testing.T) {
 	}
 }
 
+func TestMessage(t *testing.T) {
+	values := map[string]string{
+		"/admin/reports/":                    "",
+		"/admin/reports/?msg=hacked":         "",
+		"/admin/reports/?dismiss=abc":        "reports of link abc are dismissed",
+		"/admin/reports/?delete=%3Cb%3Ex%3C": "link <b>x< is deleted",
+	}
+	for target, expected := range values {
+		if msg := message(httptest.NewRequest("GET", target, nil), moderationMessages); msg != expected {
+			t.Errorf("failed %q: %q != %q", target, msg, expected)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	cfg := initConfig(t)
+	ctx := conf.SetContext(context.Background(), cfg)
+	defer cleanDb(ctx)
+
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if _, err := ParseRole("root"); err == nil {
+		t.Error("unknown role is parsed")
+	}
+	role, err := ParseRole("editor")
+	if err != nil {
+		t.Fatalf("failed role parsing: %v", err)
+	}
+	if role != RoleEditor {
+		t.Errorf("invalid role %v", role)
+	}
+	// old users without role are administrators
+	if _, _, err := CreateOrUpdate(cfg, "test", ""); err != nil {
+		t.Fatalf("failed user creation: %v", err)
+	}
+	if role, err = userRole(c, "test"); (err != nil) || (role != RoleAdmin) {
+		t.Errorf("invalid default role %v, error: %v", role, err)
+	}
+	if _, err = createUser(c, cfg, "test", RoleViewer); err == nil {
+		t.Error("user is created twice")
+	}
+	if _, err = createUser(c, cfg, "viewer", RoleViewer); err != nil {
+		t.Fatalf("failed user creation: %v", err)
+	}
+	if role, err = userRole(c, "viewer"); (err != nil) || (role != RoleViewer) {
+		t.Errorf("invalid role %v, error: %v", role, err)
+	}
+	if err = SetDisabled(c, "viewer", true); err != nil {
+		t.Fatalf("failed user disabling: %v", err)
+	}
+	if _, err = userRole(c, "viewer"); err == nil {
+		t.Error("disabled user has a role")
+	}
+	users, err := listUsers(c)
+	if err != nil {
+		t.Fatalf("failed users list: %v", err)
+	}
+	if (len(users) != 2) || (users[0].Name != "test") || !users[1].Disabled {
+		t.Errorf("invalid users list %v", users)
+	}
+	ctx = SetRoleContext(ctx, RoleEditor)
+	if !HasRole(ctx, RoleViewer) || !HasRole(ctx, RoleEditor) || HasRole(ctx, RoleAdmin) {
+		t.Error("invalid role checks")
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	cfg := initConfig(t)
+	ctx := conf.SetContext(context.Background(), cfg)
+	defer cleanDb(ctx)
+
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if err := SetPassword(c, cfg, "test", "Secret password 1"); err == nil {
+		t.Error("password of unknown user is set")
+	}
+	password, created, err := CreateOrUpdate(cfg, "test", "")
+	if err != nil {
+		t.Fatalf("failed user creation: %v", err)
+	}
+	if !created {
+		t.Error("user is not created")
+	}
+	if err = CheckPassword(c, "test", password); err != nil {
+		t.Errorf("failed generated password check: %v", err)
+	}
+	if _, _, err = CreateOrUpdate(cfg, "test", "weak"); err == nil {
+		t.Error("weak password is set")
+	}
+	if err = SetPassword(c, cfg, "test", "Secret password 1"); err != nil {
+		t.Fatalf("failed password change: %v", err)
+	}
+	if err = CheckPassword(c, "test", password); err == nil {
+		t.Error("old password is valid")
+	}
+	if err = CheckPassword(c, "test", "Secret password 1"); err != nil {
+		t.Errorf("failed password check: %v", err)
+	}
+	// hash of decoded generated password is created by old versions
+	b := make([]byte, passLen)
+	h, err := bcrypt.GenerateFromPassword(b, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernameKey, err := conf.DbKey("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Do("HSET", usernameKey, "password", hex.EncodeToString(h)); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckPassword(c, "test", hex.EncodeToString(b)); err != nil {
+		t.Errorf("failed old password check: %v", err)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	cfg := initConfig(t)
+	ctx := conf.SetContext(context.Background(), cfg)
+	defer cleanDb(ctx)
+
+	c := cfg.GetConn()
+	defer c.Close()
+
+	// fixed clock
+	ts := time.Unix(1500000000, 0)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+
+	if _, _, err := CreateOrUpdate(cfg, "test", ""); err != nil {
+		t.Fatalf("failed user creation: %v", err)
+	}
+	secret, uri, err := startTOTP(c, cfg, "test")
+	if err != nil {
+		t.Fatalf("failed TOTP start: %v", err)
+	}
+	if !strings.Contains(uri, secret) {
+		t.Errorf("invalid URI %v", uri)
+	}
+	// pending secret is not used
+	if s, err := totpSecret(c, "test"); (err != nil) || (s != "") {
+		t.Errorf("pending secret is enabled: %v", err)
+	}
+	if _, err = confirmTOTP(c, cfg, "test", "000000"); err != errInvalidCode {
+		t.Errorf("invalid code is accepted: %v", err)
+	}
+	code, err := totp.Code(secret, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := confirmTOTP(c, cfg, "test", code)
+	if err != nil {
+		t.Fatalf("failed TOTP confirmation: %v", err)
+	}
+	if len(codes) != cfg.TOTP.Codes {
+		t.Errorf("invalid number of recovery codes: %v", len(codes))
+	}
+	// the code is already used
+	if err = checkCode(c, cfg, "test", secret, code); err != errInvalidCode {
+		t.Errorf("code is used twice: %v", err)
+	}
+	// enabled secret can't be replaced without disabling
+	if _, _, err = startTOTP(c, cfg, "test"); err != errTOTPEnabled {
+		t.Errorf("enabled secret is replaced: %v", err)
+	}
+	if _, err = confirmTOTP(c, cfg, "test", code); err != errTOTPEnabled {
+		t.Errorf("enabled secret is confirmed again: %v", err)
+	}
+	if s, err := totpSecret(c, "test"); (err != nil) || (s != secret) {
+		t.Errorf("secret is changed: %v", err)
+	}
+	token, err := startLogin(c, "test")
+	if err != nil {
+		t.Fatalf("failed login start: %v", err)
+	}
+	if _, err = finishLogin(c, cfg, token, "bad-code"); err != errInvalidCode {
+		t.Errorf("invalid code is accepted: %v", err)
+	}
+	ts = ts.Add(totp.Period * time.Second)
+	code, err = totp.Code(secret, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, err := finishLogin(c, cfg, token, code)
+	if err != nil {
+		t.Fatalf("failed login: %v", err)
+	}
+	if username != "test" {
+		t.Errorf("invalid username %v", username)
+	}
+	if _, err = finishLogin(c, cfg, token, code); err == nil {
+		t.Error("token is used twice")
+	}
+	// recovery code
+	token, err = startLogin(c, "test")
+	if err != nil {
+		t.Fatalf("failed login start: %v", err)
+	}
+	if _, err = finishLogin(c, cfg, token, strings.ToUpper(codes[0])); err != nil {
+		t.Errorf("failed recovery code: %v", err)
+	}
+	if n, err := recoveryCount(c, "test"); (err != nil) || (n != cfg.TOTP.Codes-1) {
+		t.Errorf("invalid recovery codes count %v: %v", n, err)
+	}
+	if err = DisableTOTP(c, "test"); err != nil {
+		t.Fatalf("failed TOTP disabling: %v", err)
+	}
+	if s, err := totpSecret(c, "test"); (err != nil) || (s != "") {
+		t.Errorf("secret is not removed: %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	cfg := initConfig(t)
+	ctx := conf.SetContext(context.Background(), cfg)
+	defer cleanDb(ctx)
+
+	c := cfg.GetConn()
+	defer c.Close()
+
+	ts := time.Unix(1500000000, 0)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+
+	r := httptest.NewRequest("POST", "/admin/login/", nil)
+	r.Header.Set("User-Agent", "test-agent")
+	ids := make([]string, 2)
+	for i := range ids {
+		w := httptest.NewRecorder()
+		if err := setSession(w, r, c, cfg, "test"); err != nil {
+			t.Fatalf("failed session creation: %v", err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("invalid cookies %v", cookies)
+		}
+		req := httptest.NewRequest("GET", "/admin/index/", nil)
+		req.AddCookie(cookies[0])
+		username, id, err := readSession(req)
+		if err != nil {
+			t.Fatalf("failed session reading: %v", err)
+		}
+		if username != "test" {
+			t.Errorf("invalid username %v", username)
+		}
+		ids[i] = id
+	}
+	ts = ts.Add(time.Minute)
+	if err := checkSession(c, cfg, "test", ids[0]); err != nil {
+		t.Errorf("failed session check: %v", err)
+	}
+	if err := checkSession(c, cfg, "other", ids[0]); err == nil {
+		t.Error("session of other user is valid")
+	}
+	items, err := userSessions(c, "test", ids[0])
+	if err != nil {
+		t.Fatalf("failed sessions list: %v", err)
+	}
+	if (len(items) != 2) || (items[0].ID != ids[0]) || !items[0].Current || (items[0].UserAgent != "test-agent") {
+		t.Errorf("invalid sessions %v", items)
+	}
+	// absolute timeout
+	ts = ts.Add(time.Duration(cfg.Session.Absolute) * time.Second)
+	if err = checkSession(c, cfg, "test", ids[1]); err == nil {
+		t.Error("expired session is valid")
+	}
+	if err = revokeSessions(c, "test", ""); err != nil {
+		t.Fatalf("failed sessions revocation: %v", err)
+	}
+	items, err = userSessions(c, "test", "")
+	if err != nil {
+		t.Fatalf("failed sessions list: %v", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("sessions are not revoked: %v", items)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	cfg := initConfig(t)
+	ctx := conf.SetContext(context.Background(), cfg)
+	defer cleanDb(ctx)
+
+	c := cfg.GetConn()
+	defer c.Close()
+
+	cfg.Login.Attempts, cfg.Login.BaseDelay, cfg.Login.Lockout = 3, 0, 60
+	for i := 0; i < cfg.Login.Attempts-1; i++ {
+		if err := loginFailed(c, cfg, "test", "127.0.0.1", "127.0.0.1"); err != nil {
+			t.Fatalf("failed attempt registration: %v", err)
+		}
+	}
+	wait, err := loginLock(c, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed lock check: %v", err)
+	}
+	if wait != 0 {
+		t.Errorf("unexpected lock %v", wait)
+	}
+	if err = loginFailed(c, cfg, "test", "127.0.0.1", "127.0.0.1"); err != nil {
+		t.Fatalf("failed attempt registration: %v", err)
+	}
+	if wait, err = loginLock(c, "other", "127.0.0.1"); (err != nil) || (wait != 60) {
+		t.Errorf("IP address is not locked %v: %v", wait, err)
+	}
+	items, err := activeLocks(c)
+	if err != nil {
+		t.Fatalf("failed locks list: %v", err)
+	}
+	if len(items) != 2 {
+		t.Errorf("invalid locks %v", items)
+	}
+	events, err := audit.List(c, &audit.Filter{}, 10)
+	if err != nil {
+		t.Fatalf("failed audit events: %v", err)
+	}
+	if (len(events) != 2) || (events[0].Action != "login.lockout") {
+		t.Errorf("invalid audit events %v", events)
+	}
+	// progressive delay
+	cfg.Login.BaseDelay = 2
+	if err = loginFailed(c, cfg, "user", "127.0.0.2", "127.0.0.2"); err != nil {
+		t.Fatalf("failed attempt registration: %v", err)
+	}
+	if wait, err = loginLock(c, "user", "127.0.0.3"); (err != nil) || (wait != 2) {
+		t.Errorf("invalid delay %v: %v", wait, err)
+	}
+	// client's lock is hashed and limited by privacy retention
+	cfg.Privacy.Active, cfg.Privacy.Retention, cfg.Login.BaseDelay = true, 30, 0
+	r := httptest.NewRequest("POST", "/admin/login/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	client, err := loginClient(c, cfg, r)
+	if err != nil {
+		t.Fatalf("failed client identifier: %v", err)
+	}
+	if strings.Contains(client, "192.0.2") {
+		t.Errorf("client address is not hashed: %v", client)
+	}
+	for i := 0; i < cfg.Login.Attempts; i++ {
+		if err = loginFailed(c, cfg, "admin", client, "192.0.2.0"); err != nil {
+			t.Fatalf("failed attempt registration: %v", err)
+		}
+	}
+	if wait, err = loginLock(c, "other", client); (err != nil) || (wait != 30) {
+		t.Errorf("invalid client lock %v: %v", wait, err)
+	}
+	if wait, err = loginLock(c, "admin", "127.0.0.4"); (err != nil) || (wait != 60) {
+		t.Errorf("invalid user lock %v: %v", wait, err)
+	}
+}
+
+func TestEnableLink(t *testing.T) {
+	cfg := initConfig(t)
+	ctx := conf.SetContext(context.Background(), cfg)
+	defer cleanDb(ctx)
+
+	c := cfg.GetConn()
+	defer c.Close()
+
+	l := &link.Link{Short: "1", URL: "https://example.com/", Created: time.Now().UTC()}
+	if err := link.Save(c, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Disable(c, l.Short, "blocklist: example.com"); err != nil {
+		t.Fatal(err)
+	}
+	event := &audit.Event{}
+	r := httptest.NewRequest("POST", "/admin/links/enable/", strings.NewReader("short=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	code, err := EnableLink(audit.SetContext(ctx, event), w, r)
+	if (err != nil) || (code != http.StatusFound) {
+		t.Fatalf("unexpected result %v: %v", code, err)
+	}
+	if location := w.Header().Get("Location"); location != "/admin/links/?enabled=1" {
+		t.Errorf("unexpected location %v", location)
+	}
+	if (event.Action != "link.enable") || (event.Target != "1") {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if l, err = link.Get(c, "1"); (err != nil) || (l.Disabled != "") {
+		t.Errorf("link is not enabled %+v: %v", l, err)
+	}
+}
+
 func BenchmarkGetCSRF(b *testing.B) {
 	cfg := initConfig(b)
 	ctx := conf.SetContext(context.Background(), cfg)
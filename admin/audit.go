@@ -0,0 +1,132 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	// auditLimit is maximum number of events on the audit page.
+	auditLimit = 200
+	// dateLayout is a format of audit filter dates.
+	dateLayout = "2006-01-02"
+)
+
+// auditInfo is audit log page data.
+type auditInfo struct {
+	Actor  string
+	Action string
+	Target string
+	From   string
+	To     string
+	Query  template.URL
+	Events []audit.Event
+	Limit  int
+}
+
+// auditFilter returns the audit log filter from request parameters,
+// the dates are inclusive days in UTC.
+func auditFilter(r *http.Request) (*audit.Filter, error) {
+	f := &audit.Filter{
+		Actor:  strings.TrimSpace(r.FormValue("actor")),
+		Action: strings.TrimSpace(r.FormValue("action")),
+		Target: strings.TrimSpace(r.FormValue("target")),
+	}
+	if value := r.FormValue("from"); value != "" {
+		from, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return nil, errors.New("invalid from date")
+		}
+		f.From = from
+	}
+	if value := r.FormValue("to"); value != "" {
+		to, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return nil, errors.New("invalid to date")
+		}
+		f.To = to.AddDate(0, 0, 1)
+	}
+	return f, nil
+}
+
+// Audit returns the audit log page, the events can be filtered by actor,
+// action prefix, target substring and dates.
+func Audit(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	f, err := auditFilter(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	data := &auditInfo{
+		Actor:  f.Actor,
+		Action: f.Action,
+		Target: f.Target,
+		From:   r.FormValue("from"),
+		To:     r.FormValue("to"),
+		Query:  template.URL(r.URL.RawQuery),
+		Limit:  auditLimit,
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	data.Events, err = audit.List(c, f, auditLimit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_audit.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// ExportAudit returns filtered audit log events as JSON Lines file.
+func ExportAudit(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	const layout = "20060102_150405"
+
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	f, err := auditFilter(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	audit.Annotate(ctx, "audit.export", r.URL.RawQuery)
+	w.Header().Set(
+		"Content-disposition",
+		fmt.Sprintf("attachment; filename=\"lruss_audit_%v.jsonl\"", time.Now().UTC().Format(layout)),
+	)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err = audit.Export(c, f, w)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/z0rr0/lruss/access"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+)
+
+// bansInfo is banned networks page data.
+type bansInfo struct {
+	CSRF  string
+	Msg   string
+	Error string
+	Bans  []access.Ban
+}
+
+// Bans returns banned networks page, POST request bans new network
+// for a number of hours from "hours" parameter, zero is a permanent ban.
+func Bans(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &bansInfo{CSRF: csrfValue}
+	if unbanned := r.FormValue("unbanned"); unbanned != "" {
+		data.Msg = fmt.Sprintf("network %v is unbanned", unbanned)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if r.Method == "POST" {
+		// csrf is already checked
+		hours, err := strconv.ParseUint(r.PostFormValue("hours"), 10, 32)
+		if err != nil {
+			data.Error = "invalid ban period"
+		} else {
+			network, err := access.Add(c, r.PostFormValue("network"), time.Duration(hours)*time.Hour)
+			if err != nil {
+				data.Error = err.Error()
+			} else {
+				data.Msg = fmt.Sprintf("network %v is banned", network)
+				audit.Annotate(ctx, "ban.add", network)
+			}
+		}
+	}
+	data.Bans, err = access.List(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_bans.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// Unban removes a ban of the network.
+func Unban(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	network := r.PostFormValue("network")
+	audit.Annotate(ctx, "ban.remove", network)
+	if network == "" {
+		return http.StatusBadRequest, errors.New("empty network")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	err = access.Remove(c, network)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, "/admin/bans/?unbanned="+url.QueryEscape(network), http.StatusFound)
+	return http.StatusFound, nil
+}
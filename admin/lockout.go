@@ -0,0 +1,209 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/privacy"
+)
+
+const (
+	// lockRate is a kind of clients' rate limit locks.
+	lockRate = "rate"
+	// lockLogin is a kind of failed logins locks.
+	lockLogin = "login"
+)
+
+// lockInfo is a temporary lock info.
+type lockInfo struct {
+	Kind string
+	Name string
+	TTL  int
+}
+
+// lockError is an error of locked login.
+type lockError struct {
+	wait int
+}
+
+// Error returns a message of locked login.
+func (e *lockError) Error() string {
+	return fmt.Sprintf("too many failed attempts, try again in %d seconds", e.wait)
+}
+
+// locks is a sortable list of locks, the longest first.
+type locks []lockInfo
+
+func (s locks) Len() int           { return len(s) }
+func (s locks) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s locks) Less(i, j int) bool { return s[i].TTL > s[j].TTL }
+
+// loginTargets returns names of failed logins counters and locks for the username
+// and client's identifier, the last one is built by privacy settings.
+func loginTargets(username, client string) []string {
+	return []string{"user:" + username, client}
+}
+
+// loginClient returns client's identifier of the request for failed logins counters.
+func loginClient(c redis.Conn, cfg *conf.Cfg, r *http.Request) (string, error) {
+	ip := privacy.ClientIP(cfg, r)
+	if ip == nil {
+		return "", fmt.Errorf("unknown client address %q", r.RemoteAddr)
+	}
+	return privacy.ClientID(c, cfg, ip.String(), "")
+}
+
+// loginLock returns remaining time (seconds) of login lock for the username or client.
+func loginLock(c redis.Conn, username, client string) (int, error) {
+	result := 0
+	for _, target := range loginTargets(username, client) {
+		lockKey, err := conf.DbKey("lock", target)
+		if err != nil {
+			return 0, err
+		}
+		ttl, err := redis.Int(c.Do("TTL", lockKey))
+		if err != nil {
+			return 0, err
+		}
+		if ttl > result {
+			result = ttl
+		}
+	}
+	return result, nil
+}
+
+// loginFailed counts failed login attempt of the username from the client with IP address ip.
+// Every next failure delays new attempts twice longer, after maximum number of failures
+// the username or client is locked, it's registered in the audit log.
+// Client's records lifetime is limited by privacy settings.
+func loginFailed(c redis.Conn, cfg *conf.Cfg, username, client, ip string) error {
+	for i, target := range loginTargets(username, client) {
+		ttl := func(value uint) uint { return value }
+		if i > 0 {
+			ttl = cfg.ClientDataTTL
+		}
+		failKey, err := conf.DbKey("fail", target)
+		if err != nil {
+			return err
+		}
+		lockKey, err := conf.DbKey("lock", target)
+		if err != nil {
+			return err
+		}
+		n, err := redis.Int(c.Do("INCR", failKey))
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			_, err = c.Do("EXPIRE", failKey, ttl(cfg.Login.Window))
+			if err != nil {
+				return err
+			}
+		}
+		if n >= cfg.Login.Attempts {
+			_, err = c.Do("SET", lockKey, n, "EX", ttl(cfg.Login.Lockout))
+			if err != nil {
+				return err
+			}
+			_, err = c.Do("DEL", failKey)
+			if err != nil {
+				return err
+			}
+			err = audit.Record(c, cfg, &audit.Event{Actor: audit.System, Action: "login.lockout", Target: target, IP: ip})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if delay := cfg.Login.Delay(n); delay > 0 {
+			_, err = c.Do("SET", lockKey, n, "EX", ttl(delay))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loginSucceeded resets failed login attempts of the username.
+func loginSucceeded(c redis.Conn, username string) error {
+	failKey, err := conf.DbKey("fail", loginTargets(username, "")[0])
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("DEL", failKey)
+	return err
+}
+
+// activeLocks returns all clients' rate limits and failed logins locks.
+func activeLocks(c redis.Conn) ([]lockInfo, error) {
+	kinds := map[string]string{"host": lockRate, "lock": lockLogin}
+	result := locks{}
+	for prefix, kind := range kinds {
+		pattern, err := conf.DbKey(prefix, "*")
+		if err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(c.Do("KEYS", pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			ttl, err := redis.Int(c.Do("TTL", key))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, lockInfo{Kind: kind, Name: key[len(pattern)-1:], TTL: ttl})
+		}
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// Unlock removes a lock of the client.
+func Unlock(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	name := r.PostFormValue("name")
+	audit.Annotate(ctx, "lock.remove", name)
+	if name == "" {
+		return http.StatusBadRequest, errors.New("empty lock name")
+	}
+	var keys []string
+	switch r.PostFormValue("kind") {
+	case lockRate:
+		keys = []string{"host"}
+	case lockLogin:
+		keys = []string{"lock", "fail"}
+	default:
+		return http.StatusBadRequest, errors.New("unknown lock kind")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	for _, prefix := range keys {
+		dbKey, err := conf.DbKey(prefix, name)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		_, err = c.Do("DEL", dbKey)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	http.Redirect(w, r, "/admin/index/?unlocked="+url.QueryEscape(name), http.StatusFound)
+	return http.StatusFound, nil
+}
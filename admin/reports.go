@@ -0,0 +1,109 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+
+	"github.com/z0rr0/lruss/abuse"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+// moderationReason is a reason of links disabled by moderators.
+const moderationReason = "moderation: abuse reports"
+
+// moderationMessages are success alerts of moderators' actions.
+var moderationMessages = map[string]string{
+	"disable":   "link %v is disabled",
+	"delete":    "link %v is deleted",
+	"whitelist": "link %v is whitelisted",
+	"dismiss":   "reports of link %v are dismissed",
+}
+
+// reportsInfo is moderation queue page data.
+type reportsInfo struct {
+	CSRF  string
+	Msg   string
+	Site  string
+	Items []abuse.Item
+}
+
+// Reports returns moderation queue page of reported links.
+func Reports(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &reportsInfo{CSRF: csrfValue, Site: cfg.Site, Msg: message(r, moderationMessages)}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	data.Items, err = abuse.Queue(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_reports.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// ModerateLink applies moderator's action to a reported link:
+// "disable", "delete", "whitelist" or "dismiss" reports.
+func ModerateLink(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	action := r.PostFormValue("action")
+	audit.Annotate(ctx, "report."+action, r.PostFormValue("short"))
+	l, code, err := formLink(c, r)
+	if err != nil {
+		return code, err
+	}
+	switch action {
+	case "disable":
+		err = link.Disable(c, l.Short, moderationReason)
+	case "delete":
+		err = link.Delete(c, l)
+	case "whitelist":
+		err = link.Whitelist(c, l.Short)
+	case "dismiss":
+		// only reports are removed
+	default:
+		return http.StatusBadRequest, errors.New("unknown action")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = abuse.Dismiss(c, l.Short)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.Redirect(w, r, "/admin/reports/?"+action+"="+url.QueryEscape(l.Short), http.StatusFound)
+	return http.StatusFound, nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/privacy"
+)
+
+// sessionInfo is user's session metadata.
+type sessionInfo struct {
+	ID        string
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+	Current   bool
+}
+
+// sessions is a sortable list of sessions, last seen first.
+type sessions []sessionInfo
+
+func (s sessions) Len() int           { return len(s) }
+func (s sessions) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessions) Less(i, j int) bool { return s[i].LastSeen.After(s[j].LastSeen) }
+
+// sessionsInfo is user's sessions page data.
+type sessionsInfo struct {
+	CSRF     string
+	Msg      string
+	Sessions []sessionInfo
+}
+
+// sessionID returns an identifier of session cookie value,
+// only identifiers are stored in the database.
+func sessionID(value string) string {
+	h := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(h[:])
+}
+
+// readSession returns username and session identifier from the session cookie.
+func readSession(r *http.Request) (string, string, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", "", err
+	}
+	// expected: values[0] is username, values[1] is session key
+	values := strings.SplitN(cookie.Value, "::", 2)
+	if len(values) < 2 {
+		return "", "", errors.New("invalid cookie value")
+	}
+	return values[0], sessionID(values[1]), nil
+}
+
+// sessionTTL returns a lifetime of session metadata, it's limited by idle and absolute timeouts.
+func sessionTTL(cfg *conf.Cfg, created time.Time) int64 {
+	ttl := int64(cfg.Session.Absolute) - int64(now().Sub(created)/time.Second)
+	if ttl > int64(cfg.Session.Idle) {
+		return int64(cfg.Session.Idle)
+	}
+	return ttl
+}
+
+// setSession generates and sets new session key, after that creates s new session cookie.
+func setSession(w http.ResponseWriter, r *http.Request, c redis.Conn, cfg *conf.Cfg, username string) error {
+	secure, err := cfg.IsSecure()
+	if err != nil {
+		return err
+	}
+	sessionKey, err := conf.DbKey("session", username)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, sessionLen)
+	_, err = rand.Read(b)
+	if err != nil {
+		return err
+	}
+	value := base64.StdEncoding.EncodeToString(b)
+	id := sessionID(value)
+	infoKey, err := conf.DbKey("sessinfo", id)
+	if err != nil {
+		return err
+	}
+	ts := now()
+	_, err = c.Do("HMSET", infoKey,
+		"user", username,
+		"created", ts.Unix(),
+		"seen", ts.Unix(),
+		"ip", privacy.RemoteIP(cfg, r),
+		"ua", r.UserAgent(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("EXPIRE", infoKey, sessionTTL(cfg, ts))
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SADD", sessionKey, id)
+	if err != nil {
+		return err
+	}
+	cookie := http.Cookie{
+		Name:     SessionCookie,
+		Value:    fmt.Sprintf("%v::%v", username, value),
+		MaxAge:   int(cfg.Session.Absolute),
+		HttpOnly: true,
+		Path:     "/",
+		Secure:   secure,
+	}
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// checkSession verifies that the session is active and updates its last seen time.
+// Expired sessions are removed.
+func checkSession(c redis.Conn, cfg *conf.Cfg, username, id string) error {
+	infoKey, err := conf.DbKey("sessinfo", id)
+	if err != nil {
+		return err
+	}
+	values, err := redis.Values(c.Do("HMGET", infoKey, "user", "created"))
+	if err != nil {
+		return err
+	}
+	var (
+		user    string
+		created int64
+	)
+	_, err = redis.Scan(values, &user, &created)
+	if err != nil {
+		return err
+	}
+	if user != username {
+		// unknown or expired by idle timeout
+		if e := revokeSession(c, username, id); e != nil {
+			return e
+		}
+		return errors.New("invalid session key")
+	}
+	ttl := sessionTTL(cfg, time.Unix(created, 0))
+	if ttl < 1 {
+		if e := revokeSession(c, username, id); e != nil {
+			return e
+		}
+		return errors.New("session is expired")
+	}
+	_, err = c.Do("HSET", infoKey, "seen", now().Unix())
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("EXPIRE", infoKey, ttl)
+	return err
+}
+
+// userSessions returns active sessions of the user, current is an identifier of current session.
+// Identifiers of expired sessions are removed.
+func userSessions(c redis.Conn, username, current string) ([]sessionInfo, error) {
+	sessionKey, err := conf.DbKey("session", username)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := redis.Strings(c.Do("SMEMBERS", sessionKey))
+	if err != nil {
+		return nil, err
+	}
+	result := make(sessions, 0, len(ids))
+	for _, id := range ids {
+		infoKey, err := conf.DbKey("sessinfo", id)
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.Values(c.Do("HMGET", infoKey, "user", "created", "seen", "ip", "ua"))
+		if err != nil {
+			return nil, err
+		}
+		var (
+			user          string
+			created, seen int64
+		)
+		s := sessionInfo{ID: id, Current: id == current}
+		_, err = redis.Scan(values, &user, &created, &seen, &s.IP, &s.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		if user != username {
+			_, err = c.Do("SREM", sessionKey, id)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.Created, s.LastSeen = time.Unix(created, 0).UTC(), time.Unix(seen, 0).UTC()
+		result = append(result, s)
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// revokeSession removes the session of the user.
+func revokeSession(c redis.Conn, username, id string) error {
+	sessionKey, err := conf.DbKey("session", username)
+	if err != nil {
+		return err
+	}
+	infoKey, err := conf.DbKey("sessinfo", id)
+	if err != nil {
+		return err
+	}
+	n, err := redis.Int(c.Do("SREM", sessionKey, id))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// the session belongs to other user or it's already removed
+		return nil
+	}
+	_, err = c.Do("DEL", infoKey)
+	return err
+}
+
+// revokeSessions removes all sessions of the user except one with identifier except.
+func revokeSessions(c redis.Conn, username, except string) error {
+	sessionKey, err := conf.DbKey("session", username)
+	if err != nil {
+		return err
+	}
+	ids, err := redis.Strings(c.Do("SMEMBERS", sessionKey))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == except {
+			continue
+		}
+		err = revokeSession(c, username, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sessions returns active sessions page of current user.
+func Sessions(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &sessionsInfo{CSRF: csrfValue}
+	if r.FormValue("revoked") != "" {
+		data.Msg = "sessions are finished"
+	}
+	_, current, err := readSession(r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	data.Sessions, err = userSessions(c, GetContext(ctx), current)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_sessions.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// RevokeSession finishes a session of current user by its identifier,
+// "all" value finishes all sessions including current one, "others" - all except current one.
+func RevokeSession(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	_, current, err := readSession(r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	username := GetContext(ctx)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	id := r.PostFormValue("id")
+	audit.Annotate(ctx, "session.revoke", id)
+	switch id {
+	case "":
+		return http.StatusBadRequest, errors.New("empty session identifier")
+	case "all":
+		err = revokeSessions(c, username, "")
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		http.Redirect(w, r, "/admin/login/", http.StatusFound)
+		return http.StatusFound, nil
+	case "others":
+		err = revokeSessions(c, username, current)
+	default:
+		err = revokeSession(c, username, id)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if id == current {
+		http.Redirect(w, r, "/admin/login/", http.StatusFound)
+		return http.StatusFound, nil
+	}
+	http.Redirect(w, r, "/admin/sessions/?revoked=1", http.StatusFound)
+	return http.StatusFound, nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/totp"
+)
+
+const (
+	// recoveryLen is length of recovery code (bytes).
+	recoveryLen = 5
+	// loginTokenLen is length of second login step token (bytes).
+	loginTokenLen = 32
+	// loginTokenTTL is lifetime of second login step token (seconds).
+	loginTokenTTL = 300
+	// loginAttempts is maximum number of codes checks per login.
+	loginAttempts = 5
+)
+
+var (
+	// now returns current time, it can be replaced in tests.
+	now = time.Now
+
+	// errInvalidCode is an error of failed second factor check.
+	errInvalidCode = errors.New("invalid authentication code")
+	// errTOTPEnabled is an error of TOTP setup when it's already enabled,
+	// the secret can be replaced only after disabling with password check.
+	errTOTPEnabled = errors.New("two-factor authentication is already enabled")
+	// errMismatch is an error of failed credentials check.
+	errMismatch = errors.New("mismatch user or password")
+)
+
+// totpInfo is two-factor authentication page data.
+type totpInfo struct {
+	CSRF      string
+	Msg       string
+	Error     string
+	Enabled   bool
+	Secret    string
+	URI       template.URL
+	Codes     []string
+	Remaining int
+}
+
+// digest returns a hash of recovery code.
+func digest(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// totpSecret returns TOTP secret of the user or empty string if it's not enabled.
+func totpSecret(c redis.Conn, username string) (string, error) {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return "", err
+	}
+	secret, err := redis.String(c.Do("HGET", usernameKey, "totp"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return secret, err
+}
+
+// startTOTP generates new pending TOTP secret of the user,
+// it isn't used before confirmation by a valid code.
+func startTOTP(c redis.Conn, cfg *conf.Cfg, username string) (string, string, error) {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return "", "", err
+	}
+	enabled, err := totpSecret(c, username)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled != "" {
+		return "", "", errTOTPEnabled
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", "", err
+	}
+	_, err = c.Do("HSET", usernameKey, "totp_pending", secret)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(cfg.TOTP.Issuer, username, secret), nil
+}
+
+// confirmTOTP enables pending TOTP secret if the code is valid,
+// it returns new recovery codes.
+func confirmTOTP(c redis.Conn, cfg *conf.Cfg, username, code string) ([]string, error) {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := totpSecret(c, username)
+	if err != nil {
+		return nil, err
+	}
+	if enabled != "" {
+		return nil, errTOTPEnabled
+	}
+	secret, err := redis.String(c.Do("HGET", usernameKey, "totp_pending"))
+	if err == redis.ErrNil {
+		return nil, errors.New("two-factor authentication setup is not started")
+	}
+	if err != nil {
+		return nil, err
+	}
+	counter, ok := totp.Validate(secret, strings.TrimSpace(code), now(), cfg.TOTP.Skew)
+	if !ok {
+		return nil, errInvalidCode
+	}
+	_, err = c.Do("HMSET", usernameKey, "totp", secret, "totp_counter", counter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.Do("HDEL", usernameKey, "totp_pending")
+	if err != nil {
+		return nil, err
+	}
+	return newRecoveryCodes(c, cfg, username)
+}
+
+// newRecoveryCodes replaces recovery codes of the user.
+// Only hashes of codes are stored, every code can be used once.
+func newRecoveryCodes(c redis.Conn, cfg *conf.Cfg, username string) ([]string, error) {
+	recoveryKey, err := conf.DbKey("recovery", username)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, cfg.TOTP.Codes)
+	args := redis.Args{}.Add(recoveryKey)
+	for i := range codes {
+		b := make([]byte, recoveryLen)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		value := hex.EncodeToString(b)
+		codes[i] = value[:recoveryLen] + "-" + value[recoveryLen:]
+		args = args.Add(digest(codes[i]))
+	}
+	_, err = c.Do("DEL", recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.Do("SADD", args...)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// recoveryCount returns a number of unused recovery codes.
+func recoveryCount(c redis.Conn, username string) (int, error) {
+	recoveryKey, err := conf.DbKey("recovery", username)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(c.Do("SCARD", recoveryKey))
+}
+
+// DisableTOTP turns off two-factor authentication of the user.
+func DisableTOTP(c redis.Conn, username string) error {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return err
+	}
+	recoveryKey, err := conf.DbKey("recovery", username)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HDEL", usernameKey, "totp", "totp_pending", "totp_counter")
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("DEL", recoveryKey)
+	return err
+}
+
+// checkCode verifies TOTP or recovery code of the user.
+// Every TOTP code can be used only once, a used recovery code is removed.
+func checkCode(c redis.Conn, cfg *conf.Cfg, username, secret, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		usernameKey, err := conf.DbKey("user", username)
+		if err != nil {
+			return err
+		}
+		counter, ok := totp.Validate(secret, code, now(), cfg.TOTP.Skew)
+		if !ok {
+			return errInvalidCode
+		}
+		last, err := redis.Uint64(c.Do("HGET", usernameKey, "totp_counter"))
+		if (err != nil) && (err != redis.ErrNil) {
+			return err
+		}
+		if counter <= last {
+			return errInvalidCode
+		}
+		_, err = c.Do("HSET", usernameKey, "totp_counter", counter)
+		return err
+	}
+	recoveryKey, err := conf.DbKey("recovery", username)
+	if err != nil {
+		return err
+	}
+	n, err := redis.Int(c.Do("SREM", recoveryKey, digest(code)))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// startLogin saves a token of the user who has passed the first login step.
+func startLogin(c redis.Conn, username string) (string, error) {
+	b := make([]byte, loginTokenLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	mfaKey, err := conf.DbKey("mfa", token)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.Do("HMSET", mfaKey, "user", username, "attempts", 0)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.Do("EXPIRE", mfaKey, loginTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// finishLogin checks second factor code for the token and returns authenticated username,
+// it's also returned with errInvalidCode.
+// The token is removed after success or too many attempts.
+func finishLogin(c redis.Conn, cfg *conf.Cfg, token, code string) (string, error) {
+	mfaKey, err := conf.DbKey("mfa", token)
+	if err != nil {
+		return "", err
+	}
+	username, err := redis.String(c.Do("HGET", mfaKey, "user"))
+	if err == redis.ErrNil {
+		return "", errors.New("login session is expired")
+	}
+	if err != nil {
+		return "", err
+	}
+	attempts, err := redis.Int(c.Do("HINCRBY", mfaKey, "attempts", 1))
+	if err != nil {
+		return "", err
+	}
+	if attempts > loginAttempts {
+		_, err = c.Do("DEL", mfaKey)
+		if err != nil {
+			return "", err
+		}
+		return "", errors.New("too many attempts")
+	}
+	secret, err := totpSecret(c, username)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", errors.New("two-factor authentication is disabled")
+	}
+	err = checkCode(c, cfg, username, secret, code)
+	if err != nil {
+		// username is returned to count failed attempts
+		return username, err
+	}
+	_, err = c.Do("DEL", mfaKey)
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// TwoFactor shows two-factor authentication settings of current user.
+// POST actions: "enroll" generates a secret, "confirm" enables it (only if it's not enabled yet),
+// "codes" regenerates recovery codes and "disable" turns it off.
+// New secret and recovery codes are shown only once.
+func TwoFactor(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	username := GetContext(ctx)
+	data := &totpInfo{CSRF: csrfValue}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if r.Method == "POST" {
+		// csrf is already checked
+		switch r.PostFormValue("action") {
+		case "enroll":
+			secret, uri, err := startTOTP(c, cfg, username)
+			if err == errTOTPEnabled {
+				data.Error = err.Error()
+				break
+			}
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			data.Secret = secret
+			if strings.HasPrefix(uri, "otpauth://") {
+				// otpauth scheme is escaped by templates, the URI is built by totp package
+				data.URI = template.URL(uri)
+			}
+		case "confirm":
+			data.Codes, err = confirmTOTP(c, cfg, username, r.PostFormValue("code"))
+			if err != nil {
+				data.Error = err.Error()
+			} else {
+				data.Msg = "two-factor authentication is enabled, save recovery codes, they are shown only once"
+				audit.Annotate(ctx, "totp.enable", "user:"+username)
+			}
+		case "codes":
+			if CheckPassword(c, username, r.PostFormValue("password")) != nil {
+				data.Error = "invalid password"
+				break
+			}
+			data.Codes, err = newRecoveryCodes(c, cfg, username)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			data.Msg = "new recovery codes are generated, old ones are not valid"
+			audit.Annotate(ctx, "totp.codes", "user:"+username)
+		case "disable":
+			if CheckPassword(c, username, r.PostFormValue("password")) != nil {
+				data.Error = "invalid password"
+				break
+			}
+			err = DisableTOTP(c, username)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			data.Msg = "two-factor authentication is disabled"
+			audit.Annotate(ctx, "totp.disable", "user:"+username)
+		default:
+			return http.StatusBadRequest, errors.New("unknown action")
+		}
+	}
+	secret, err := totpSecret(c, username)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data.Enabled = secret != ""
+	if data.Enabled {
+		data.Remaining, err = recoveryCount(c, username)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_totp.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
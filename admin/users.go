@@ -0,0 +1,330 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by s BSD-style license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+// Role is a level of user's permissions.
+type Role int
+
+// Roles from minimal to maximal permissions level.
+const (
+	// RoleNone is a role of anonymous user.
+	RoleNone Role = iota
+	// RoleViewer can see statistics and own links.
+	RoleViewer
+	// RoleEditor can manage own links.
+	RoleEditor
+	// RoleAdmin can do everything.
+	RoleAdmin
+)
+
+const (
+	// roleKey is internal role context key.
+	roleKey key = "role"
+)
+
+var (
+	// roleNames are names of users' roles.
+	roleNames = map[Role]string{
+		RoleNone:   Anonymous,
+		RoleViewer: "viewer",
+		RoleEditor: "editor",
+		RoleAdmin:  "admin",
+	}
+
+	// isUsername is regexp pattern to check username.
+	isUsername = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// userInfo is user's data.
+type userInfo struct {
+	Name     string
+	Role     Role
+	Disabled bool
+	TOTP     bool
+	Sessions int
+}
+
+// users is a sortable list of users.
+type users []userInfo
+
+func (s users) Len() int           { return len(s) }
+func (s users) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s users) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// usersInfo is users administration page data.
+type usersInfo struct {
+	CSRF     string
+	Msg      string
+	Error    string
+	Password string
+	User     string
+	Roles    []Role
+	Users    []userInfo
+}
+
+// String returns a name of the role.
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// ParseRole returns a role by its name.
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if (role != RoleNone) && (roleName == name) {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", name)
+}
+
+// IsValidUsername checks username is valid.
+func IsValidUsername(username string) bool {
+	return (username != Anonymous) && isUsername.MatchString(username)
+}
+
+// SetRoleContext writes user's role to context.
+func SetRoleContext(ctx context.Context, role Role) context.Context {
+	return context.WithValue(ctx, roleKey, role)
+}
+
+// GetRoleContext reads user's role from context.
+func GetRoleContext(ctx context.Context) Role {
+	role, ok := ctx.Value(roleKey).(Role)
+	if !ok {
+		return RoleNone
+	}
+	return role
+}
+
+// HasRole checks that the user from context has the role or higher one.
+func HasRole(ctx context.Context, role Role) bool {
+	return GetRoleContext(ctx) >= role
+}
+
+// getUser returns user's data.
+// Users without saved role are created before roles support, they are administrators.
+func getUser(c redis.Conn, username string) (*userInfo, error) {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Strings(c.Do("HMGET", usernameKey, "password", "role", "disabled", "totp"))
+	if err != nil {
+		return nil, err
+	}
+	if values[0] == "" {
+		return nil, fmt.Errorf("unknown user %q", username)
+	}
+	user := &userInfo{Name: username, Role: RoleAdmin, Disabled: values[2] == "1", TOTP: values[3] != ""}
+	if values[1] != "" {
+		user.Role, err = ParseRole(values[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// userRole returns a role of the active user.
+func userRole(c redis.Conn, username string) (Role, error) {
+	user, err := getUser(c, username)
+	if err != nil {
+		return RoleNone, err
+	}
+	if user.Disabled {
+		return RoleNone, fmt.Errorf("user %q is disabled", username)
+	}
+	return user.Role, nil
+}
+
+// SetRole changes user's role.
+func SetRole(c redis.Conn, username string, role Role) error {
+	if role == RoleNone {
+		return errors.New("empty role")
+	}
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", usernameKey, "role", role.String())
+	return err
+}
+
+// SetDisabled disables or enables the user, all sessions of disabled user are removed.
+func SetDisabled(c redis.Conn, username string, disabled bool) error {
+	usernameKey, err := conf.DbKey("user", username)
+	if err != nil {
+		return err
+	}
+	value := 0
+	if disabled {
+		value = 1
+	}
+	_, err = c.Do("HSET", usernameKey, "disabled", value)
+	if err != nil {
+		return err
+	}
+	if !disabled {
+		return nil
+	}
+	return revokeSessions(c, username, "")
+}
+
+// listUsers returns all users.
+func listUsers(c redis.Conn) ([]userInfo, error) {
+	pattern, err := conf.DbKey("user", "*")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := redis.Strings(c.Do("KEYS", pattern))
+	if err != nil {
+		return nil, err
+	}
+	result := make(users, len(keys))
+	for i, key := range keys {
+		user, err := getUser(c, key[len(pattern)-1:])
+		if err != nil {
+			return nil, err
+		}
+		active, err := userSessions(c, user.Name, "")
+		if err != nil {
+			return nil, err
+		}
+		user.Sessions = len(active)
+		result[i] = *user
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// canManage checks the user from context can change the link.
+func canManage(ctx context.Context, l *link.Link) bool {
+	if HasRole(ctx, RoleAdmin) {
+		return true
+	}
+	return HasRole(ctx, RoleEditor) && (l.Owner == link.UserOwner(GetContext(ctx)))
+}
+
+// Users returns users management page and creates new user by POST request.
+func Users(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	csrfValue, err := GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &usersInfo{
+		CSRF:  csrfValue,
+		Msg:   message(r, map[string]string{"updated": "user %v is updated"}),
+		User:  GetContext(ctx),
+		Roles: []Role{RoleViewer, RoleEditor, RoleAdmin},
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if r.Method == "POST" {
+		// csrf is already checked
+		username := strings.TrimSpace(r.PostFormValue("user"))
+		role, err := ParseRole(r.PostFormValue("role"))
+		switch {
+		case err != nil:
+			data.Error = err.Error()
+		case !IsValidUsername(username):
+			data.Error = "invalid username"
+		default:
+			data.Password, err = createUser(c, cfg, username, role)
+			if err != nil {
+				data.Error = err.Error()
+			} else {
+				data.Msg = fmt.Sprintf("user '%v' is created, copy the password, it is shown only once", username)
+				audit.Annotate(ctx, "user.create", "user:"+username)
+			}
+		}
+	}
+	data.Users, err = listUsers(c)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "admin_users.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// UpdateUser changes user's role, disables/enables the user or resets its two-factor authentication.
+func UpdateUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	username := r.PostFormValue("user")
+	audit.Annotate(ctx, "user."+r.PostFormValue("action"), "user:"+username)
+	if !IsValidUsername(username) {
+		return http.StatusBadRequest, errors.New("invalid username")
+	}
+	if username == GetContext(ctx) {
+		return http.StatusBadRequest, errors.New("own account can't be changed")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	user, err := getUser(c, username)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	switch r.PostFormValue("action") {
+	case "role":
+		role, err := ParseRole(r.PostFormValue("role"))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		err = SetRole(c, username, role)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "disable":
+		err = SetDisabled(c, username, !user.Disabled)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "totp":
+		err = DisableTOTP(c, username)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	default:
+		return http.StatusBadRequest, errors.New("unknown action")
+	}
+	http.Redirect(w, r, "/admin/users/?updated="+url.QueryEscape(username), http.StatusFound)
+	return http.StatusFound, nil
+}
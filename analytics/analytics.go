@@ -0,0 +1,217 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package analytics implements daily statistics of links and requests.
+// It doesn't store any clients' identifiers.
+package analytics
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	// dayLayout is a date format of db keys.
+	dayLayout = "20060102"
+	// noReferrer is referrer name for direct requests.
+	noReferrer = "direct"
+)
+
+// Day is statistics of one day.
+type Day struct {
+	Date     string `json:"date"`
+	Links    int64  `json:"links"`
+	Clicks   int64  `json:"clicks"`
+	Requests int64  `json:"requests"`
+	Errors4x int64  `json:"errors_4xx"`
+	Errors5x int64  `json:"errors_5xx"`
+}
+
+// ErrorRate returns a percent of failed requests.
+func (d Day) ErrorRate() float64 {
+	if d.Requests == 0 {
+		return 0
+	}
+	return float64(d.Errors4x+d.Errors5x) * 100 / float64(d.Requests)
+}
+
+// Item is a counted item of top list.
+type Item struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// items is a sortable list of top items.
+type items []Item
+
+func (s items) Len() int      { return len(s) }
+func (s items) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s items) Less(i, j int) bool {
+	if s[i].Count == s[j].Count {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].Count > s[j].Count
+}
+
+// dayKey returns a db key of statistics kind for the day t.
+func dayKey(kind string, t time.Time) (string, error) {
+	return conf.DbKey("stats", fmt.Sprintf("%v:%v", kind, t.UTC().Format(dayLayout)))
+}
+
+// incr increments a field of daily statistics hash.
+func incr(c redis.Conn, cfg *conf.Cfg, field string) error {
+	dbKey, err := dayKey("day", time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HINCRBY", dbKey, field, 1)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("EXPIRE", dbKey, cfg.Analytics.TTL())
+	return err
+}
+
+// zincr increments a member of daily top sorted set.
+func zincr(c redis.Conn, cfg *conf.Cfg, kind, member string) error {
+	dbKey, err := dayKey(kind, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("ZINCRBY", dbKey, 1, member)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("EXPIRE", dbKey, cfg.Analytics.TTL())
+	return err
+}
+
+// Created registers new short link.
+func Created(c redis.Conn, cfg *conf.Cfg) error {
+	if !cfg.Analytics.Active {
+		return nil
+	}
+	return incr(c, cfg, "links")
+}
+
+// Click registers a redirect by short link.
+func Click(c redis.Conn, cfg *conf.Cfg, short string, r *http.Request) error {
+	if !cfg.Analytics.Active {
+		return nil
+	}
+	err := incr(c, cfg, "clicks")
+	if err != nil {
+		return err
+	}
+	err = zincr(c, cfg, "top", short)
+	if err != nil {
+		return err
+	}
+	referrer := noReferrer
+	if u, err := url.Parse(r.Referer()); (err == nil) && (u.Host != "") {
+		referrer = u.Hostname()
+	}
+	return zincr(c, cfg, "ref", referrer)
+}
+
+// Campaign registers a redirect by short link with campaign parameters.
+func Campaign(c redis.Conn, cfg *conf.Cfg, name string) error {
+	if !cfg.Analytics.Active || (name == "") {
+		return nil
+	}
+	return zincr(c, cfg, "camp", name)
+}
+
+// Request registers handled HTTP request with status code.
+func Request(c redis.Conn, cfg *conf.Cfg, code int) error {
+	if !cfg.Analytics.Active {
+		return nil
+	}
+	err := incr(c, cfg, "requests")
+	if err != nil {
+		return err
+	}
+	switch {
+	case code >= http.StatusInternalServerError:
+		err = incr(c, cfg, "errors_5xx")
+	case code >= http.StatusBadRequest:
+		err = incr(c, cfg, "errors_4xx")
+	}
+	return err
+}
+
+// Daily returns statistics of last days, the first one is oldest.
+func Daily(c redis.Conn, days int) ([]Day, error) {
+	result := make([]Day, days)
+	now := time.Now()
+	for i := range result {
+		t := now.AddDate(0, 0, i-days+1)
+		dbKey, err := dayKey("day", t)
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.Int64Map(c.Do("HGETALL", dbKey))
+		if err != nil {
+			return nil, err
+		}
+		result[i] = Day{
+			Date:     t.UTC().Format("2006-01-02"),
+			Links:    values["links"],
+			Clicks:   values["clicks"],
+			Requests: values["requests"],
+			Errors4x: values["errors_4xx"],
+			Errors5x: values["errors_5xx"],
+		}
+	}
+	return result, nil
+}
+
+// top returns limit most frequent items of last days.
+func top(c redis.Conn, kind string, days, limit int) ([]Item, error) {
+	counts := make(map[string]int64)
+	now := time.Now()
+	for i := 0; i < days; i++ {
+		dbKey, err := dayKey(kind, now.AddDate(0, 0, -i))
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.Int64Map(c.Do("ZRANGE", dbKey, 0, -1, "WITHSCORES"))
+		if err != nil {
+			return nil, err
+		}
+		for name, n := range values {
+			counts[name] += n
+		}
+	}
+	result := make(items, 0, len(counts))
+	for name, n := range counts {
+		result = append(result, Item{Name: name, Count: n})
+	}
+	sort.Sort(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// TopLinks returns limit short links with maximum clicks during last days.
+func TopLinks(c redis.Conn, days, limit int) ([]Item, error) {
+	return top(c, "top", days, limit)
+}
+
+// TopReferrers returns limit most frequent referrers' hosts during last days.
+func TopReferrers(c redis.Conn, days, limit int) ([]Item, error) {
+	return top(c, "ref", days, limit)
+}
+
+// TopCampaigns returns limit campaigns with maximum clicks during last days.
+func TopCampaigns(c redis.Conn, days, limit int) ([]Item, error) {
+	return top(c, "camp", days, limit)
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package analytics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	cfg.Analytics.Active = true
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestErrorRate(t *testing.T) {
+	d := Day{Requests: 8, Errors4x: 1, Errors5x: 1}
+	if r := d.ErrorRate(); r != 25 {
+		t.Errorf("unexpected error rate %v", r)
+	}
+	d = Day{}
+	if r := d.ErrorRate(); r != 0 {
+		t.Errorf("unexpected error rate %v", r)
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	if err := Created(c, cfg); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/1", nil)
+	for _, short := range []string{"1", "2", "2"} {
+		if err := Click(c, cfg, short, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Header.Set("Referer", "https://example.com/page")
+	if err := Click(c, cfg, "1", r); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable} {
+		if err := Request(c, cfg, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	days, err := Daily(c, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(days); n != 7 {
+		t.Fatalf("unexpected days number %d", n)
+	}
+	expected := Day{Date: days[6].Date, Links: 1, Clicks: 4, Requests: 3, Errors4x: 1, Errors5x: 1}
+	if days[6] != expected {
+		t.Errorf("unexpected day statistics %+v", days[6])
+	}
+	links, err := TopLinks(c, 7, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(links) != 1) || (links[0] != Item{Name: "1", Count: 2}) {
+		t.Errorf("unexpected top links %v", links)
+	}
+	referrers, err := TopReferrers(c, 7, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(referrers) != 2) || (referrers[0] != Item{Name: noReferrer, Count: 3}) {
+		t.Errorf("unexpected top referrers %v", referrers)
+	}
+	for _, name := range []string{"spring", "", "spring", "autumn"} {
+		if err := Campaign(c, cfg, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	campaigns, err := TopCampaigns(c, 7, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(campaigns) != 2) || (campaigns[0] != Item{Name: "spring", Count: 2}) {
+		t.Errorf("unexpected top campaigns %v", campaigns)
+	}
+}
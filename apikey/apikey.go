@@ -0,0 +1,269 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package apikey implements API keys management for programmatic links creation.
+// Only SHA-256 hashes of keys are stored.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/ratelimit"
+)
+
+const (
+	// prefix is a prefix of all API keys.
+	prefix = "lruss_"
+	// keyLen is length of API key random part (bytes).
+	keyLen = 24
+	// bearer is authorization header scheme.
+	bearer = "Bearer "
+)
+
+var (
+	// ErrInvalid is an error of unknown or revoked API key.
+	ErrInvalid = errors.New("invalid API key")
+	// ErrExists is an error of API key creation with already used name.
+	ErrExists = errors.New("API key already exists")
+
+	// isName is regexp pattern to check API key name.
+	isName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// Key is API key info.
+type Key struct {
+	Name    string
+	Created time.Time
+	Rate    int64
+	Quota   int64
+	Used    int64
+	Revoked bool
+}
+
+// keys is a sortable list of API keys.
+type keys []Key
+
+func (s keys) Len() int           { return len(s) }
+func (s keys) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s keys) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// digest returns a hash of the API key.
+func digest(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// IsValidName checks API key name is valid.
+func IsValidName(name string) bool {
+	return isName.MatchString(name)
+}
+
+// Create generates new API key with a name, it returns its value
+// that is not stored and can't be got later.
+// A rate is allowed number of links per API keys interval, a quota is total
+// number of links, zero values are unlimited.
+func Create(c redis.Conn, name string, rate, quota int64) (string, error) {
+	if !IsValidName(name) {
+		return "", fmt.Errorf("invalid API key name %q", name)
+	}
+	if (rate < 0) || (quota < 0) {
+		return "", errors.New("invalid API key limits")
+	}
+	nameKey, err := conf.DbKey("apikey", name)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, keyLen)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := prefix + hex.EncodeToString(b)
+	h := digest(token)
+	created, err := redis.Int(c.Do("HSETNX", nameKey, "digest", h))
+	if err != nil {
+		return "", err
+	}
+	if created == 0 {
+		return "", ErrExists
+	}
+	_, err = c.Do("HMSET", nameKey,
+		"created", time.Now().Unix(),
+		"rate", rate,
+		"quota", quota,
+		"used", 0,
+		"revoked", 0,
+	)
+	if err != nil {
+		return "", err
+	}
+	digestKey, err := conf.DbKey("key", h)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.Do("SET", digestKey, name)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke disables API key by its name.
+func Revoke(c redis.Conn, name string) error {
+	nameKey, err := conf.DbKey("apikey", name)
+	if err != nil {
+		return err
+	}
+	h, err := redis.String(c.Do("HGET", nameKey, "digest"))
+	if err == redis.ErrNil {
+		return fmt.Errorf("API key %q not found", name)
+	}
+	if err != nil {
+		return err
+	}
+	digestKey, err := conf.DbKey("key", h)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("DEL", digestKey)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", nameKey, "revoked", 1)
+	return err
+}
+
+// get returns API key info by its name.
+func get(c redis.Conn, name string) (*Key, error) {
+	nameKey, err := conf.DbKey("apikey", name)
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Values(c.Do("HMGET", nameKey, "created", "rate", "quota", "used", "revoked"))
+	if err != nil {
+		return nil, err
+	}
+	var created, revoked int64
+	key := &Key{Name: name}
+	_, err = redis.Scan(values, &created, &key.Rate, &key.Quota, &key.Used, &revoked)
+	if err != nil {
+		return nil, err
+	}
+	if created == 0 {
+		return nil, ErrInvalid
+	}
+	key.Created, key.Revoked = time.Unix(created, 0).UTC(), revoked == 1
+	return key, nil
+}
+
+// List returns all API keys.
+func List(c redis.Conn) ([]Key, error) {
+	pattern, err := conf.DbKey("apikey", "*")
+	if err != nil {
+		return nil, err
+	}
+	dbKeys, err := redis.Strings(c.Do("KEYS", pattern))
+	if err != nil {
+		return nil, err
+	}
+	result := make(keys, len(dbKeys))
+	for i, dbKey := range dbKeys {
+		key, err := get(c, dbKey[len(pattern)-1:])
+		if err != nil {
+			return nil, err
+		}
+		result[i] = *key
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// FromRequest returns API key info from request's authorization header.
+// It returns nil if the header is not set.
+func FromRequest(c redis.Conn, r *http.Request) (*Key, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(header, bearer) {
+		return nil, ErrInvalid
+	}
+	digestKey, err := conf.DbKey("key", digest(strings.TrimSpace(header[len(bearer):])))
+	if err != nil {
+		return nil, err
+	}
+	name, err := redis.String(c.Do("GET", digestKey))
+	if err == redis.ErrNil {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := get(c, name)
+	if err != nil {
+		return nil, err
+	}
+	if key.Revoked {
+		return nil, ErrInvalid
+	}
+	return key, nil
+}
+
+// Allowed checks API key rate limit during interval.
+// It returns nil if the key doesn't have a rate limit.
+func Allowed(c redis.Conn, key *Key, interval time.Duration) (*ratelimit.Result, error) {
+	if key.Rate == 0 {
+		return nil, nil
+	}
+	rateKey, err := conf.DbKey("keyrate", key.Name)
+	if err != nil {
+		return nil, err
+	}
+	limiter := &ratelimit.FixedWindow{Limit: key.Rate, Window: interval}
+	return limiter.Allow(c, rateKey)
+}
+
+// RateStatus returns current API key rate limit state without request registration.
+// It returns nil if the key doesn't have a rate limit.
+func RateStatus(c redis.Conn, key *Key, interval time.Duration) (*ratelimit.Result, error) {
+	if key.Rate == 0 {
+		return nil, nil
+	}
+	rateKey, err := conf.DbKey("keyrate", key.Name)
+	if err != nil {
+		return nil, err
+	}
+	limiter := &ratelimit.FixedWindow{Limit: key.Rate, Window: interval}
+	return limiter.Peek(c, rateKey)
+}
+
+// Use increments a number of used API key's links and checks its quota.
+func Use(c redis.Conn, key *Key) (bool, error) {
+	nameKey, err := conf.DbKey("apikey", key.Name)
+	if err != nil {
+		return false, err
+	}
+	n, err := redis.Int64(c.Do("HINCRBY", nameKey, "used", 1))
+	if err != nil {
+		return false, err
+	}
+	if (key.Quota > 0) && (n > key.Quota) {
+		// rejected link is not counted
+		_, err = c.Do("HINCRBY", nameKey, "used", -1)
+		return false, err
+	}
+	key.Used = n
+	return true, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package apikey
+
+import (
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestKeys(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	if _, err := Create(c, "bad name", 0, 0); err == nil {
+		t.Error("unexpected behavior")
+	}
+	token, err := Create(c, "test", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, prefix) {
+		t.Errorf("invalid key %v", token)
+	}
+	if _, err = Create(c, "test", 0, 0); err != ErrExists {
+		t.Errorf("unexpected error %v", err)
+	}
+	r := httptest.NewRequest("POST", "/api/add", nil)
+	if key, err := FromRequest(c, r); (key != nil) || (err != nil) {
+		t.Errorf("unexpected result %v, %v", key, err)
+	}
+	r.Header.Set("Authorization", "Bearer bad")
+	if _, err = FromRequest(c, r); err != ErrInvalid {
+		t.Errorf("unexpected error %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	key, err := FromRequest(c, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (key.Name != "test") || (key.Rate != 1) || (key.Quota != 2) || key.Revoked {
+		t.Errorf("unexpected key %+v", key)
+	}
+	for i, expected := range []bool{true, false} {
+		result, err := Allowed(c, key, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != expected {
+			t.Errorf("unexpected rate result %d: %+v", i, result)
+		}
+	}
+	result, err := RateStatus(c, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || (result.Remaining != 0) || (result.Reset <= 0) {
+		t.Errorf("unexpected rate status %+v", result)
+	}
+	for i, expected := range []bool{true, true, false} {
+		allowed, err := Use(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != expected {
+			t.Errorf("unexpected quota result %d: %v", i, allowed)
+		}
+	}
+	if err = Revoke(c, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FromRequest(c, r); err != ErrInvalid {
+		t.Errorf("unexpected error %v", err)
+	}
+	keys, err := List(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(keys) != 1) || !keys[0].Revoked || (keys[0].Used != 2) {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package audit implements a log of security and administrative events.
+// Events are only appended to a capped list, they can't be changed,
+// the oldest ones are removed after the retention period.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	// System is an actor of events without authenticated user.
+	System = "system"
+	// CLI is an actor of command line events.
+	CLI = "cli"
+
+	// eventKey is internal event context key.
+	eventKey key = "audit"
+	// trimLimit is maximum number of expired events removed at once.
+	trimLimit = 100
+)
+
+// key is internal context key.
+type key string
+
+// Event is an audit log record.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	IP     string    `json:"ip"`
+	Code   int       `json:"code,omitempty"`
+}
+
+// Filter is a condition of events search, empty fields are ignored.
+// Action is a prefix of events' actions, Target is a substring of events' targets.
+type Filter struct {
+	Actor  string
+	Action string
+	Target string
+	From   time.Time
+	To     time.Time
+}
+
+// Match checks the event satisfies the filter.
+func (f *Filter) Match(e *Event) bool {
+	switch {
+	case (f.Actor != "") && (e.Actor != f.Actor):
+		return false
+	case (f.Action != "") && !strings.HasPrefix(e.Action, f.Action):
+		return false
+	case (f.Target != "") && !strings.Contains(e.Target, f.Target):
+		return false
+	case !f.From.IsZero() && e.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && !e.Time.Before(f.To):
+		return false
+	}
+	return true
+}
+
+// SetContext saves new request's event to the context, handlers can annotate it.
+func SetContext(ctx context.Context, e *Event) context.Context {
+	return context.WithValue(ctx, eventKey, e)
+}
+
+// GetContext returns request's event from the context or nil if it's not set.
+func GetContext(ctx context.Context) *Event {
+	e, ok := ctx.Value(eventKey).(*Event)
+	if !ok {
+		return nil
+	}
+	return e
+}
+
+// Annotate sets an action and a target of request's event.
+func Annotate(ctx context.Context, action, target string) {
+	if e := GetContext(ctx); e != nil {
+		e.Action, e.Target = action, target
+	}
+}
+
+// SetActor sets an actor of request's event, it's used when the actor is authenticated by the request.
+func SetActor(ctx context.Context, actor string) {
+	if e := GetContext(ctx); e != nil {
+		e.Actor = actor
+	}
+}
+
+// Record appends new event to the log, current time is used if it's not set.
+func Record(c redis.Conn, cfg *conf.Cfg, e *Event) error {
+	logKey, err := conf.DbKey("audit", "log")
+	if err != nil {
+		return err
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("LPUSH", logKey, b)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("LTRIM", logKey, 0, cfg.Audit.Size-1)
+	if err != nil {
+		return err
+	}
+	return trim(c, logKey, e.Time.Add(-cfg.Audit.Period()))
+}
+
+// trim removes events which are older than the time t.
+func trim(c redis.Conn, logKey string, t time.Time) error {
+	for i := 0; i < trimLimit; i++ {
+		value, err := redis.Bytes(c.Do("LINDEX", logKey, -1))
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &Event{}
+		err = json.Unmarshal(value, e)
+		if err != nil {
+			return err
+		}
+		if !e.Time.Before(t) {
+			return nil
+		}
+		_, err = c.Do("LREM", logKey, -1, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn for all events which satisfy the filter, newest first.
+// It stops if fn returns false.
+func scan(c redis.Conn, f *Filter, fn func(e *Event) (bool, error)) error {
+	logKey, err := conf.DbKey("audit", "log")
+	if err != nil {
+		return err
+	}
+	values, err := redis.ByteSlices(c.Do("LRANGE", logKey, 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		e := &Event{}
+		err = json.Unmarshal(value, e)
+		if err != nil {
+			return err
+		}
+		if !f.Match(e) {
+			continue
+		}
+		next, err := fn(e)
+		if err != nil {
+			return err
+		}
+		if !next {
+			break
+		}
+	}
+	return nil
+}
+
+// List returns limit last events which satisfy the filter, newest first.
+func List(c redis.Conn, f *Filter, limit int) ([]Event, error) {
+	var result []Event
+	err := scan(c, f, func(e *Event) (bool, error) {
+		result = append(result, *e)
+		return len(result) < limit, nil
+	})
+	return result, err
+}
+
+// Export writes all events which satisfy the filter as JSON Lines, newest first.
+func Export(c redis.Conn, f *Filter, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return scan(c, f, func(e *Event) (bool, error) {
+		return true, encoder.Encode(e)
+	})
+}
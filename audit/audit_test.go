@@ -0,0 +1,189 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestRecord(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	actions := []string{"login", "logout"}
+	for _, action := range actions {
+		err := Record(c, cfg, &Event{Actor: "test", Action: action, Target: "user:test", IP: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("failed event recording: %v", err)
+		}
+	}
+	events, err := List(c, &Filter{}, 10)
+	if err != nil {
+		t.Fatalf("failed events reading: %v", err)
+	}
+	if len(events) != len(actions) {
+		t.Fatalf("invalid events %v", events)
+	}
+	if (events[0].Action != "logout") || events[0].Time.IsZero() {
+		t.Errorf("invalid last event %v", events[0])
+	}
+	// capped log
+	cfg.Audit.Size = 2
+	err = Record(c, cfg, &Event{Actor: CLI, Action: "user.create", Target: "user:test"})
+	if err != nil {
+		t.Fatalf("failed event recording: %v", err)
+	}
+	events, err = List(c, &Filter{}, 10)
+	if err != nil {
+		t.Fatalf("failed events reading: %v", err)
+	}
+	if (len(events) != 2) || (events[1].Action != "logout") {
+		t.Errorf("invalid capped events %v", events)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	ts := time.Now().UTC()
+	times := []time.Time{ts.Add(-2 * cfg.Audit.Period()), ts.Add(-cfg.Audit.Period() - time.Hour), ts}
+	for _, t0 := range times {
+		err := Record(c, cfg, &Event{Time: t0, Actor: "test", Action: "login"})
+		if err != nil {
+			t.Fatalf("failed event recording: %v", err)
+		}
+	}
+	events, err := List(c, &Filter{}, 10)
+	if err != nil {
+		t.Fatalf("failed events reading: %v", err)
+	}
+	if (len(events) != 1) || !events[0].Time.Equal(ts) {
+		t.Errorf("expired events are not removed %v", events)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	ts := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	items := []*Event{
+		{Time: ts, Actor: "alice", Action: "login", Target: "user:alice"},
+		{Time: ts.Add(time.Hour), Actor: "alice", Action: "link.update", Target: "abc"},
+		{Time: ts.Add(2 * time.Hour), Actor: "bob", Action: "link.delete", Target: "abd"},
+		{Time: ts.Add(24 * time.Hour), Actor: CLI, Action: "user.create", Target: "user:bob"},
+	}
+	for _, e := range items {
+		if err := Record(c, cfg, e); err != nil {
+			t.Fatalf("failed event recording: %v", err)
+		}
+	}
+	cases := []struct {
+		f *Filter
+		n int
+	}{
+		{&Filter{}, 4},
+		{&Filter{Actor: "alice"}, 2},
+		{&Filter{Action: "link."}, 2},
+		{&Filter{Target: "ab"}, 2},
+		{&Filter{Target: "user:", Actor: CLI}, 1},
+		{&Filter{From: ts.Add(time.Hour)}, 3},
+		{&Filter{To: ts.Add(2 * time.Hour)}, 2},
+		{&Filter{Actor: "nobody"}, 0},
+	}
+	for i, v := range cases {
+		events, err := List(c, v.f, 10)
+		if err != nil {
+			t.Fatalf("failed events reading: %v", err)
+		}
+		if len(events) != v.n {
+			t.Errorf("case %d: invalid events %v", i, events)
+		}
+	}
+	events, err := List(c, &Filter{}, 1)
+	if err != nil {
+		t.Fatalf("failed events reading: %v", err)
+	}
+	if (len(events) != 1) || (events[0].Action != "user.create") {
+		t.Errorf("invalid limited events %v", events)
+	}
+	b := &bytes.Buffer{}
+	err = Export(c, &Filter{Actor: "alice"}, b)
+	if err != nil {
+		t.Fatalf("failed export: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("invalid export lines %v", lines)
+	}
+	e := &Event{}
+	if err = json.Unmarshal([]byte(lines[0]), e); err != nil {
+		t.Fatalf("invalid export line: %v", err)
+	}
+	if (e.Action != "link.update") || (e.Target != "abc") {
+		t.Errorf("invalid exported event %v", e)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	// no event, nothing happens
+	Annotate(ctx, "login", "user:test")
+	if GetContext(ctx) != nil {
+		t.Error("unexpected event")
+	}
+	e := &Event{Actor: "test"}
+	ctx = SetContext(ctx, e)
+	Annotate(ctx, "login", "user:test")
+	SetActor(ctx, "other")
+	if (e.Action != "login") || (e.Target != "user:test") || (e.Actor != "other") {
+		t.Errorf("invalid event %v", e)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package blocklist implements local blocklist of phishing and malware URLs.
+// Lists are loaded from files in plain text (one hostname or URL prefix per line)
+// or hosts format ("0.0.0.0 example.com"), a hostname blocks its subdomains too.
+// Existing links are periodically checked and matched ones are disabled.
+package blocklist
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+// Reason is a prefix of disabled links' reason.
+const Reason = "blocklist: "
+
+var (
+	// mutex protects loaded lists.
+	mutex sync.RWMutex
+	// current is loaded blocklist.
+	current = &list{hosts: map[string]bool{}}
+	// localHosts are names of local addresses used in hosts files.
+	localHosts = map[string]bool{
+		"localhost":             true,
+		"localhost.localdomain": true,
+		"local":                 true,
+		"broadcasthost":         true,
+		"ip6-localhost":         true,
+		"ip6-loopback":          true,
+		"ip6-localnet":          true,
+		"ip6-mcastprefix":       true,
+		"ip6-allnodes":          true,
+		"ip6-allrouters":        true,
+		"0.0.0.0":               true,
+	}
+)
+
+// list is a set of blocked hosts and URLs prefixes.
+type list struct {
+	hosts    map[string]bool
+	prefixes []string
+}
+
+// prefix returns normalized URL, it's used for prefixes comparison.
+func prefix(u *url.URL) string {
+	v, err := link.Normalize(u, nil)
+	if err != nil {
+		return u.String()
+	}
+	return v.String()
+}
+
+// add appends a hostname or URL prefix to the list.
+func (l *list) add(entry string) {
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if (err != nil) || (u.Host == "") {
+			return
+		}
+		l.prefixes = append(l.prefixes, prefix(u))
+		return
+	}
+	host, err := link.Host(entry)
+	if (err == nil) && (host != "") && !localHosts[host] {
+		l.hosts[host] = true
+	}
+}
+
+// parseLine adds entries of a line in plain text or hosts format.
+func (l *list) parseLine(line string) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	if net.ParseIP(fields[0]) != nil {
+		// hosts format: IP address and host names
+		for _, name := range fields[1:] {
+			l.add(name)
+		}
+		return
+	}
+	for _, entry := range fields {
+		l.add(entry)
+	}
+}
+
+// read adds entries from the file.
+func (l *list) read(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l.parseLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// match returns matched entry of the URL.
+func (l *list) match(u *url.URL) (string, bool) {
+	host, err := link.Host(u.Hostname())
+	for (err == nil) && (host != "") {
+		if l.hosts[host] {
+			return host, true
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	if len(l.prefixes) > 0 {
+		value := prefix(u)
+		for _, p := range l.prefixes {
+			if strings.HasPrefix(value, p) {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Load reads blocklist files, previous lists are kept if some file can't be read.
+func Load(cfg *conf.Cfg) error {
+	l := &list{hosts: map[string]bool{}}
+	for _, name := range cfg.Blocklist.Files {
+		if err := l.read(name); err != nil {
+			return err
+		}
+	}
+	mutex.Lock()
+	current = l
+	mutex.Unlock()
+	return nil
+}
+
+// Size returns numbers of loaded hosts and URLs prefixes.
+func Size() (int, int) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(current.hosts), len(current.prefixes)
+}
+
+// Match checks the URL by the blocklist and returns matched hostname or URL prefix.
+func Match(u *url.URL) (string, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current.match(u)
+}
+
+// Targets returns additional target URLs of a link, e.g. targets of its redirect rules.
+type Targets func(c redis.Conn, short string) ([]string, error)
+
+// matchLink returns a matched blocklist entry of link's URL or its additional targets.
+func matchLink(c redis.Conn, l *link.Link, targets Targets) (string, bool, error) {
+	values := []string{l.URL}
+	if targets != nil {
+		items, err := targets(c, l.Short)
+		if err != nil {
+			return "", false, err
+		}
+		values = append(values, items...)
+	}
+	for _, value := range values {
+		u, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+		if entry, ok := Match(u); ok {
+			return entry, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Sweep checks existing links and disables blocked ones, whitelisted links are skipped.
+// A link is blocked if its URL or one of additional targets is matched, targets can be nil.
+// It returns a number of new disabled links.
+func Sweep(c redis.Conn, cfg *conf.Cfg, targets Targets) (int, error) {
+	items, err := link.List(c, "", "")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, l := range items {
+		if (l.Disabled != "") || l.Whitelisted {
+			continue
+		}
+		entry, ok, err := matchLink(c, &l, targets)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		err = link.Disable(c, l.Short, Reason+entry)
+		if err == link.ErrNotFound {
+			// the link is already deleted
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		e := &audit.Event{Actor: audit.System, Action: "link.disable", Target: l.Short}
+		if err = audit.Record(c, cfg, e); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sweep runs one check of existing links.
+func sweep(cfg *conf.Cfg, logger *log.Logger, targets Targets) {
+	c := cfg.GetConn()
+	defer c.Close()
+
+	n, err := Sweep(c, cfg, targets)
+	if err != nil {
+		logger.Printf("blocklist sweep error: %v", err)
+	}
+	if n > 0 {
+		logger.Printf("blocklist sweep: %d links are disabled", n)
+	}
+}
+
+// Run periodically reloads blocklist files and checks existing links until the context is done.
+// Additional links' targets are checked if targets isn't nil.
+func Run(ctx context.Context, cfg *conf.Cfg, logger *log.Logger, targets Targets) {
+	refresh := time.NewTicker(cfg.Blocklist.RefreshPeriod())
+	defer refresh.Stop()
+	check := time.NewTicker(cfg.Blocklist.SweepPeriod())
+	defer check.Stop()
+
+	sweep(cfg, logger, targets)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			if err := Load(cfg); err != nil {
+				// previous lists are used
+				logger.Printf("blocklist reload error: %v", err)
+			}
+		case <-check.C:
+			sweep(cfg, logger, targets)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package blocklist
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "lruss_blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostsFile := writeFile(t, "# hosts\n127.0.0.1 localhost\n0.0.0.0 evil.com  www.malware.org\n::1 ip6-localhost\n")
+	defer os.Remove(hostsFile)
+	plainFile := writeFile(t, "phishing.net.\n\nHTTPS://Example.COM/login # prefix\n")
+	defer os.Remove(plainFile)
+
+	cfg.Blocklist.Files = []string{hostsFile, plainFile}
+	if err = Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cfg.Blocklist.Files = nil
+		Load(cfg)
+	}()
+	if hosts, prefixes := Size(); (hosts != 3) || (prefixes != 1) {
+		t.Errorf("unexpected size %v, %v", hosts, prefixes)
+	}
+	items := map[string]string{
+		"https://evil.com/":                "evil.com",
+		"http://sub.EVIL.com./page":        "evil.com",
+		"https://malware.org/":             "",
+		"https://www.malware.org:8080/":    "www.malware.org",
+		"https://phishing.net/":            "phishing.net",
+		"https://example.com/login?user=1": "https://example.com/login",
+		"https://EXAMPLE.com/login/form":   "https://example.com/login",
+		"https://example.com/":             "",
+		"http://example.com/login":         "",
+		"https://localhost/":               "",
+		"https://notevil.com/":             "",
+	}
+	for value, expected := range items {
+		u, err := url.Parse(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := Match(u)
+		if (entry != expected) || (ok != (expected != "")) {
+			t.Errorf("unexpected result for %v: %v %v", value, entry, ok)
+		}
+	}
+	cfg.Blocklist.Files = []string{hostsFile, "/not/existing/file"}
+	if err = Load(cfg); err == nil {
+		t.Error("unexpected behavior")
+	}
+	if hosts, _ := Size(); hosts != 3 {
+		t.Error("previous lists are not kept")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	name := writeFile(t, "evil.com\n")
+	defer os.Remove(name)
+	cfg.Blocklist.Files = []string{name}
+	if err := Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cfg.Blocklist.Files = nil
+		Load(cfg)
+	}()
+	now := time.Now().UTC()
+	items := []link.Link{
+		{Short: "1", URL: "https://example.com/", Created: now},
+		{Short: "2", URL: "https://www.evil.com/", Created: now},
+		{Short: "3", URL: "https://example.org/", Created: now},
+	}
+	for i := range items {
+		if err := link.Save(c, &items[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a blocked host is reached by the additional target of link "3"
+	targets := func(c redis.Conn, short string) ([]string, error) {
+		if short == "3" {
+			return []string{"https://example.net/", "https://evil.com/app"}, nil
+		}
+		return []string{"https://example.net/"}, nil
+	}
+	n, err := Sweep(c, cfg, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("unexpected number of disabled links %v", n)
+	}
+	for _, item := range items {
+		l, err := link.Get(c, item.Short)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disabled := l.Short != "1"; disabled != (l.Disabled == Reason+"evil.com") {
+			t.Errorf("unexpected link %+v", l)
+		}
+	}
+	// already disabled links are skipped
+	if n, err = Sweep(c, cfg, targets); (err != nil) || (n != 0) {
+		t.Errorf("unexpected result %v: %v", n, err)
+	}
+	events, err := audit.List(c, &audit.Filter{Action: "link.disable"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(events) != 2) || (events[0].Actor != audit.System) {
+		t.Errorf("unexpected events %v", events)
+	}
+}
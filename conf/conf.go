@@ -18,25 +18,61 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/metrics"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	// cfgKey is configuration context key.
 	cfgKey key = "cfg"
+	// maxPasswordLen is maximum password length supported by bcrypt (bytes).
+	maxPasswordLen = 72
 )
 
 var (
+	// ReferrerPolicies are values of Referrer-Policy header.
+	ReferrerPolicies = []string{
+		"no-referrer",
+		"no-referrer-when-downgrade",
+		"origin",
+		"origin-when-cross-origin",
+		"same-origin",
+		"strict-origin",
+		"strict-origin-when-cross-origin",
+		"unsafe-url",
+	}
 	// dbPrefixes is databases prefixes for special variables.
 	dbPrefixes = map[string]string{
-		"count":   "count",
-		"host":    "host",
-		"tpl":     "tpl",
-		"url":     "url",
-		"csrf":    "csrf",
-		"session": "session",
-		"user":    "user",
+		"count":    "count",
+		"host":     "host",
+		"tpl":      "tpl",
+		"url":      "url",
+		"csrf":     "csrf",
+		"session":  "session",
+		"user":     "user",
+		"salt":     "salt",
+		"stats":    "stats",
+		"hook":     "hook",
+		"apikey":   "apikey",
+		"key":      "key",
+		"keyrate":  "keyrate",
+		"link":     "link",
+		"owner":    "owner",
+		"recovery": "recovery",
+		"mfa":      "mfa",
+		"sessinfo": "sessinfo",
+		"fail":     "fail",
+		"lock":     "lock",
+		"audit":    "audit",
+		"ban":      "ban",
+		"dest":     "dest",
+		"report":   "report",
+		"reports":  "reports",
+		"reporter": "reporter",
+		"rules":    "rules",
 	}
 )
 
@@ -56,25 +92,677 @@ type rediscfg struct {
 	timeout  time.Duration
 }
 
+// limit is a rate limit settings, count requests are allowed during interval (seconds).
+// Burst is a capacity of "token" algorithm.
+type limit struct {
+	Algorithm string `json:"algorithm"`
+	Interval  uint   `json:"interval"`
+	Count     int64  `json:"count"`
+	Burst     int64  `json:"burst"`
+}
+
+// isValid checks the limit settings.
+func (l *limit) isValid() error {
+	switch l.Algorithm {
+	case "", "fixed", "sliding", "token":
+	default:
+		return fmt.Errorf("unknown rate algorithm %q", l.Algorithm)
+	}
+	if l.Count < 1 {
+		return errors.New("invalid rate count")
+	}
+	if l.Interval < 1 {
+		return errors.New("invalid rate internal")
+	}
+	if l.Burst < 0 {
+		return errors.New("invalid rate burst")
+	}
+	return nil
+}
+
 // rate is rate configuration settings.
+// Main limit is used for anonymous links creation,
+// Routes are limits of other handlers, e.g. "redirect" or "/admin/login".
 type rate struct {
-	Active         bool  `json:"active"`
-	Interval       uint  `json:"interval"`
-	Count          int64 `json:"count"`
-	CheckUserAgent bool  `json:"check_user_agent"`
+	Active         bool             `json:"active"`
+	Algorithm      string           `json:"algorithm"`
+	Interval       uint             `json:"interval"`
+	Count          int64            `json:"count"`
+	Burst          int64            `json:"burst"`
+	CheckUserAgent bool             `json:"check_user_agent"`
+	IPv4Prefix     int              `json:"ipv4_prefix"`
+	IPv6Prefix     int              `json:"ipv6_prefix"`
+	Routes         map[string]limit `json:"routes"`
+}
+
+// Aggregate returns a network prefix of the IP address, so all clients
+// of the network share the same rate limits. Zero prefix length means full address.
+func (r *rate) Aggregate(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		if r.IPv4Prefix == 0 {
+			return ip4
+		}
+		return ip4.Mask(net.CIDRMask(r.IPv4Prefix, 32))
+	}
+	if r.IPv6Prefix == 0 {
+		return ip
+	}
+	return ip.Mask(net.CIDRMask(r.IPv6Prefix, 128))
+}
+
+// Limit returns rate limit settings of the route, "api" is anonymous links creation.
+func (r *rate) Limit(route string) (limit, bool) {
+	if route == "api" {
+		return limit{Algorithm: r.Algorithm, Interval: r.Interval, Count: r.Count, Burst: r.Burst}, true
+	}
+	l, ok := r.Routes[route]
+	return l, ok
+}
+
+// api is API settings.
+type api struct {
+	RequireKey  bool `json:"require_key"`
+	KeyInterval uint `json:"key_interval"`
+}
+
+// isValid checks API settings, default interval of API keys rate limits is 1 minute.
+func (a *api) isValid() error {
+	if a.KeyInterval == 0 {
+		a.KeyInterval = 60
+	}
+	return nil
+}
+
+// KeyWindow returns an interval of API keys rate limits.
+func (a *api) KeyWindow() time.Duration {
+	return time.Duration(a.KeyInterval) * time.Second
+}
+
+// proxies is reverse proxies settings, client IP address headers
+// are used only from trusted networks.
+type proxies struct {
+	Trusted  []string `json:"trusted"`
+	networks []*net.IPNet
+}
+
+// IsTrusted checks the IP address belongs to trusted proxies networks.
+func (p *proxies) IsTrusted(ip net.IP) bool {
+	return contains(p.networks, ip)
+}
+
+// ParseNetwork parses CIDR network, single IP address is a network with full mask.
+func ParseNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// parseNetworks parses a list of CIDR networks, single IP addresses are allowed too.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, len(values))
+	for i, value := range values {
+		network, err := ParseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = network
+	}
+	return result, nil
+}
+
+// ipList is IP addresses allow and deny lists.
+type ipList struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// isValid parses the networks lists.
+func (l *ipList) isValid() error {
+	var err error
+	l.allow, err = parseNetworks(l.Allow)
+	if err != nil {
+		return err
+	}
+	l.deny, err = parseNetworks(l.Deny)
+	return err
+}
+
+// Permits checks the IP address isn't denied and it's allowed if allow list is not empty.
+func (l *ipList) Permits(ip net.IP) bool {
+	if contains(l.deny, ip) {
+		return false
+	}
+	return (len(l.allow) == 0) || contains(l.allow, ip)
+}
+
+// access is IP addresses restrictions of API and administration routes.
+type access struct {
+	API   ipList `json:"api"`
+	Admin ipList `json:"admin"`
+}
+
+// contains checks the IP address belongs to one of networks.
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlPolicy is destination URLs policy settings.
+// Domains lists files are checked for changes every Reload seconds, zero disables it.
+type urlPolicy struct {
+	Schemes   []string `json:"schemes"`
+	MaxLength int      `json:"max_length"`
+	AllowFile string   `json:"allow_file"`
+	DenyFile  string   `json:"deny_file"`
+	Reload    uint     `json:"reload"`
+	// Strip are patterns of removed query parameters, e.g. "utm_*".
+	Strip []string `json:"strip"`
+}
+
+// isValid checks URL policy settings, http and https schemes are allowed by default.
+func (p *urlPolicy) isValid() error {
+	if len(p.Schemes) == 0 {
+		p.Schemes = []string{"http", "https"}
+	}
+	for i, scheme := range p.Schemes {
+		p.Schemes[i] = strings.ToLower(strings.TrimSpace(scheme))
+		if p.Schemes[i] == "" {
+			return errors.New("empty URL scheme")
+		}
+	}
+	if p.MaxLength == 0 {
+		p.MaxLength = 2048
+	}
+	if p.MaxLength < 1 {
+		return errors.New("invalid URL max length")
+	}
+	return nil
+}
+
+// ReloadPeriod returns a period of domains lists files checks.
+func (p *urlPolicy) ReloadPeriod() time.Duration {
+	return time.Duration(p.Reload) * time.Second
+}
+
+// blocklist is local blocklist settings.
+// Files are reloaded every Refresh seconds, existing links are checked every Sweep seconds.
+type blocklist struct {
+	Active  bool     `json:"active"`
+	Files   []string `json:"files"`
+	Refresh uint     `json:"refresh"`
+	Sweep   uint     `json:"sweep"`
+}
+
+// isValid checks blocklist settings.
+func (b *blocklist) isValid() error {
+	if !b.Active {
+		return nil
+	}
+	if len(b.Files) == 0 {
+		return errors.New("empty blocklist files")
+	}
+	if (b.Refresh < 1) || (b.Sweep < 1) {
+		return errors.New("invalid blocklist periods")
+	}
+	return nil
+}
+
+// RefreshPeriod returns a period of blocklist files reloading.
+func (b *blocklist) RefreshPeriod() time.Duration {
+	return time.Duration(b.Refresh) * time.Second
+}
+
+// SweepPeriod returns a period of existing links checks.
+func (b *blocklist) SweepPeriod() time.Duration {
+	return time.Duration(b.Sweep) * time.Second
+}
+
+// leavePage is settings of "You are leaving" page shown before redirects.
+// If it's active, the page is shown for links to domains not matching Trusted patterns.
+type leavePage struct {
+	Active  bool     `json:"active"`
+	Trusted []string `json:"trusted"`
+}
+
+// isValid checks leaving page settings.
+func (p *leavePage) isValid() error {
+	for i, pattern := range p.Trusted {
+		p.Trusted[i] = strings.ToLower(strings.TrimSpace(pattern))
+		if p.Trusted[i] == "" {
+			return errors.New("empty trusted domain")
+		}
+	}
+	return nil
+}
+
+// rules is settings of links' conditional redirects, a link can have Max rules.
+// Clients' countries are detected by GeoIP file in CSV format "network,country",
+// country rules don't match anything if the file is empty.
+type rules struct {
+	Active bool   `json:"active"`
+	GeoIP  string `json:"geoip"`
+	Max    int    `json:"max"`
+}
+
+// redirect is default settings of short links redirects.
+// Responses with permanent status codes are cached MaxAge seconds if it's not zero.
+type redirect struct {
+	Status         int    `json:"status"`
+	MaxAge         uint   `json:"max_age"`
+	ReferrerPolicy string `json:"referrer_policy"`
+}
+
+// isValid checks redirect settings, 302 is a default status code.
+func (d *redirect) isValid() error {
+	if d.Status == 0 {
+		d.Status = http.StatusFound
+	}
+	if !IsRedirectStatus(d.Status) {
+		return fmt.Errorf("invalid redirect status %d", d.Status)
+	}
+	if !IsReferrerPolicy(d.ReferrerPolicy) {
+		return fmt.Errorf("invalid referrer policy %q", d.ReferrerPolicy)
+	}
+	return nil
+}
+
+// IsRedirectStatus checks the code is a supported redirect status.
+func IsRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// IsPermanentRedirect checks the code is a permanent redirect status.
+func IsPermanentRedirect(code int) bool {
+	return (code == http.StatusMovedPermanently) || (code == http.StatusPermanentRedirect)
+}
+
+// IsReferrerPolicy checks the value is a known Referrer-Policy header value, empty one is valid too.
+func IsReferrerPolicy(value string) bool {
+	if value == "" {
+		return true
+	}
+	for _, policy := range ReferrerPolicies {
+		if policy == value {
+			return true
+		}
+	}
+	return false
+}
+
+// reports is abuse reports settings, Keep is a number of saved reports per link.
+type reports struct {
+	Active bool `json:"active"`
+	Keep   int  `json:"keep"`
+}
+
+// privacy is client data privacy settings.
+type privacy struct {
+	Active    bool `json:"active"`
+	IPv4Mask  int  `json:"ipv4_mask"`
+	IPv6Mask  int  `json:"ipv6_mask"`
+	Hash      bool `json:"hash"`
+	SaltTTL   uint `json:"salt_ttl"`
+	Retention uint `json:"retention"`
+}
+
+// metricsCfg is metrics export settings.
+type metricsCfg struct {
+	Active bool   `json:"active"`
+	Host   string `json:"host"`
+	Port   uint   `json:"port"`
+}
+
+// analytics is daily statistics settings.
+type analytics struct {
+	Active    bool `json:"active"`
+	Retention uint `json:"retention"`
+	TopSize   int  `json:"top_size"`
+}
+
+// TTL returns a lifetime (seconds) of daily statistics records.
+func (a *analytics) TTL() uint {
+	// one more day to keep the oldest one during whole day
+	return (a.Retention + 1) * 24 * 3600
+}
+
+// subscription is webhook subscriber settings.
+type subscription struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// webhooks is links events notifications settings.
+type webhooks struct {
+	Active        bool           `json:"active"`
+	Timeout       int64          `json:"timeout"`
+	Retries       int            `json:"retries"`
+	Backoff       int64          `json:"backoff"`
+	Subscriptions []subscription `json:"subscriptions"`
+	timeout       time.Duration
+}
+
+// RequestTimeout returns webhook HTTP request timeout.
+func (wh *webhooks) RequestTimeout() time.Duration {
+	return wh.timeout
+}
+
+// RetryDelay returns a delay before next delivery attempt,
+// it grows exponentially, but not more than one hour.
+func (wh *webhooks) RetryDelay(attempt int) time.Duration {
+	delay := time.Duration(wh.Backoff) * time.Second
+	for i := 1; (i < attempt) && (delay < time.Hour); i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		return time.Hour
+	}
+	return delay
+}
+
+// Subscribers returns URLs of event subscribers.
+func (wh *webhooks) Subscribers(event string) []string {
+	var result []string
+	for _, s := range wh.Subscriptions {
+		for _, e := range s.Events {
+			if e == event {
+				result = append(result, s.URL)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Secret returns a secret key of subscriber with URL target.
+func (wh *webhooks) Secret(target string) (string, bool) {
+	for _, s := range wh.Subscriptions {
+		if s.URL == target {
+			return s.Secret, true
+		}
+	}
+	return "", false
+}
+
+// isValid checks webhooks settings.
+func (wh *webhooks) isValid() error {
+	if wh.Timeout < 1 {
+		return errors.New("invalid webhooks timeout")
+	}
+	wh.timeout = time.Duration(wh.Timeout) * time.Second
+	if (wh.Retries < 0) || (wh.Backoff < 1) {
+		return errors.New("invalid webhooks retries settings")
+	}
+	for _, s := range wh.Subscriptions {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http") && (u.Scheme != "https") {
+			return fmt.Errorf("invalid webhook URL %v", s.URL)
+		}
+		if len(s.Events) == 0 {
+			return fmt.Errorf("no events for webhook %v", s.URL)
+		}
+	}
+	return nil
+}
+
+// passwords is users' passwords policy settings.
+type passwords struct {
+	MinLength int `json:"min_length"`
+	Classes   int `json:"classes"`
+	Cost      int `json:"cost"`
+}
+
+// Check verifies that the password satisfies the policy: it has minimal length
+// and contains required number of characters classes (lower case, upper case, digits, others).
+func (p *passwords) Check(password string) error {
+	if len(password) < p.MinLength {
+		return fmt.Errorf("password is shorter than %d characters", p.MinLength)
+	}
+	if len(password) > maxPasswordLen {
+		return fmt.Errorf("password is longer than %d bytes", maxPasswordLen)
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.Classes {
+		return fmt.Errorf("password should contain %d of: lower case, upper case letters, digits, other symbols", p.Classes)
+	}
+	return nil
+}
+
+// isValid checks passwords settings, default minimal length is 10 characters.
+func (p *passwords) isValid() error {
+	if p.MinLength == 0 {
+		p.MinLength = 10
+	}
+	if (p.MinLength < 1) || (p.MinLength > maxPasswordLen) {
+		return errors.New("invalid password minimal length")
+	}
+	if (p.Classes < 0) || (p.Classes > 4) {
+		return errors.New("invalid password classes number")
+	}
+	if p.Cost == 0 {
+		p.Cost = bcrypt.DefaultCost
+	}
+	if (p.Cost < bcrypt.MinCost) || (p.Cost > bcrypt.MaxCost) {
+		return errors.New("invalid password hash cost")
+	}
+	return nil
+}
+
+// auditCfg is audit log settings.
+type auditCfg struct {
+	Size      int  `json:"size"`
+	Retention uint `json:"retention"`
+}
+
+// isValid checks audit log settings, defaults are 10000 events and 365 days retention.
+func (a *auditCfg) isValid() error {
+	if a.Size == 0 {
+		a.Size = 10000
+	}
+	if a.Retention == 0 {
+		a.Retention = 365
+	}
+	if a.Size < 1 {
+		return errors.New("invalid audit log settings")
+	}
+	return nil
+}
+
+// Period returns a retention period of audit events.
+func (a *auditCfg) Period() time.Duration {
+	return time.Duration(a.Retention) * 24 * time.Hour
+}
+
+// login is failed logins protection settings.
+type login struct {
+	Attempts  int  `json:"attempts"`
+	Window    uint `json:"window"`
+	BaseDelay int  `json:"delay"`
+	Lockout   uint `json:"lockout"`
+}
+
+// isValid checks login protection settings, every missing value uses a default:
+// 10 attempts during 15 minutes, 1 second delay and 15 minutes lockout.
+// Delay -1 disables progressive delays.
+func (l *login) isValid() error {
+	switch {
+	case l.BaseDelay == 0:
+		l.BaseDelay = 1
+	case l.BaseDelay == -1:
+		l.BaseDelay = 0
+	case l.BaseDelay < 0:
+		return errors.New("invalid login delay")
+	}
+	if l.Attempts == 0 {
+		l.Attempts = 10
+	}
+	if l.Window == 0 {
+		l.Window = 900
+	}
+	if l.Lockout == 0 {
+		l.Lockout = 900
+	}
+	if l.Attempts < 1 {
+		return errors.New("invalid login protection settings")
+	}
+	return nil
+}
+
+// Delay returns a delay (seconds) before next login attempt after n failed ones,
+// it grows exponentially, but not more than lockout period.
+func (l *login) Delay(n int) uint {
+	if l.BaseDelay < 1 {
+		return 0
+	}
+	delay := uint(l.BaseDelay)
+	for i := 1; (i < n) && (delay < l.Lockout); i++ {
+		delay *= 2
+	}
+	if delay > l.Lockout {
+		return l.Lockout
+	}
+	return delay
+}
+
+// session is admin sessions settings.
+type session struct {
+	Idle     uint `json:"idle"`
+	Absolute uint `json:"absolute"`
+}
+
+// isValid checks sessions timeouts, defaults are 1 hour idle and 1 day absolute ones.
+func (s *session) isValid() error {
+	if s.Idle == 0 {
+		s.Idle = 3600
+	}
+	if s.Absolute == 0 {
+		s.Absolute = 86400
+	}
+	if s.Absolute < s.Idle {
+		return errors.New("invalid session timeouts")
+	}
+	return nil
+}
+
+// twoFactor is two-factor authentication settings.
+type twoFactor struct {
+	Issuer string `json:"issuer"`
+	Skew   int    `json:"skew"`
+	Codes  int    `json:"recovery_codes"`
+}
+
+// isValid checks two-factor authentication settings, every missing value uses a default:
+// skew 1 period and 10 recovery codes. Skew -1 allows only current period's codes.
+func (tf *twoFactor) isValid() error {
+	switch tf.Skew {
+	case 0:
+		tf.Skew = 1
+	case -1:
+		tf.Skew = 0
+	}
+	if tf.Issuer == "" {
+		tf.Issuer = "LRUSS"
+	}
+	if tf.Codes == 0 {
+		tf.Codes = 10
+	}
+	if (tf.Skew < 0) || (tf.Skew > 10) {
+		return errors.New("invalid TOTP skew")
+	}
+	if tf.Codes < 1 {
+		return errors.New("invalid number of recovery codes")
+	}
+	return nil
+}
+
+// conn is redis connection which counts failed commands.
+type conn struct {
+	redis.Conn
+}
+
+// isFailure checks the error is a failed command, "NOSCRIPT" reply is expected
+// by scripts' EVALSHA command before loading the script by EVAL.
+func isFailure(err error) bool {
+	if e, ok := err.(redis.Error); ok {
+		return !strings.HasPrefix(string(e), "NOSCRIPT")
+	}
+	return err != nil
+}
+
+// Do sends a command to the server and returns the received reply.
+func (c *conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	if isFailure(err) {
+		metrics.RedisErrors.Inc()
+	}
+	return reply, err
 }
 
 // Cfg is rates' configuration settings.
 type Cfg struct {
-	Host               string   `json:"host"`
-	Port               uint     `json:"port"`
-	Site               string   `json:"site"`
-	Timeout            int64    `json:"timeout"`
-	TerminationTimeout int64    `json:"termination"`
-	CSRFTimeout        uint     `json:"csrf_timeout"`
-	Static             string   `json:"static"`
-	Rate               rate     `json:"rate"`
-	Redis              rediscfg `json:"redis"`
+	Host               string     `json:"host"`
+	Port               uint       `json:"port"`
+	Site               string     `json:"site"`
+	Timeout            int64      `json:"timeout"`
+	TerminationTimeout int64      `json:"termination"`
+	CSRFTimeout        uint       `json:"csrf_timeout"`
+	Static             string     `json:"static"`
+	Rate               rate       `json:"rate"`
+	API                api        `json:"api"`
+	Proxies            proxies    `json:"proxies"`
+	Access             access     `json:"access"`
+	Policy             urlPolicy  `json:"policy"`
+	Blocklist          blocklist  `json:"blocklist"`
+	Interstitial       leavePage  `json:"interstitial"`
+	Reports            reports    `json:"reports"`
+	Redirect           redirect   `json:"redirect"`
+	Rules              rules      `json:"rules"`
+	Privacy            privacy    `json:"privacy"`
+	Metrics            metricsCfg `json:"metrics"`
+	Analytics          analytics  `json:"analytics"`
+	Webhooks           webhooks   `json:"webhooks"`
+	Password           passwords  `json:"password"`
+	TOTP               twoFactor  `json:"totp"`
+	Session            session    `json:"session"`
+	Login              login      `json:"login"`
+	Audit              auditCfg   `json:"audit"`
+	Redis              rediscfg   `json:"redis"`
 	timeout            time.Duration
 	terminationTimeout time.Duration
 	pool               *redis.Pool
@@ -107,12 +795,93 @@ func (c *Cfg) isValid() error {
 	c.Site = strings.TrimRight(c.Site, "/ ")
 
 	if c.Rate.Active {
-		if c.Rate.Count < 1 {
-			return errors.New("invalid rate count")
+		for route := range c.Rate.Routes {
+			l, _ := c.Rate.Limit(route)
+			if err := l.isValid(); err != nil {
+				return fmt.Errorf("%v: %v", route, err)
+			}
+		}
+		l, _ := c.Rate.Limit("api")
+		if err := l.isValid(); err != nil {
+			return err
+		}
+		if (c.Rate.IPv4Prefix < 0) || (c.Rate.IPv4Prefix > 32) {
+			return errors.New("invalid rate IPv4 prefix")
+		}
+		if (c.Rate.IPv6Prefix < 0) || (c.Rate.IPv6Prefix > 128) {
+			return errors.New("invalid rate IPv6 prefix")
+		}
+	}
+	if err := c.API.isValid(); err != nil {
+		return err
+	}
+	networks, err := parseNetworks(c.Proxies.Trusted)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	c.Proxies.networks = networks
+	if err := c.Access.API.isValid(); err != nil {
+		return fmt.Errorf("invalid API access lists: %v", err)
+	}
+	if err := c.Access.Admin.isValid(); err != nil {
+		return fmt.Errorf("invalid admin access lists: %v", err)
+	}
+	if err := c.Policy.isValid(); err != nil {
+		return err
+	}
+	if err := c.Blocklist.isValid(); err != nil {
+		return err
+	}
+	if err := c.Interstitial.isValid(); err != nil {
+		return err
+	}
+	if c.Reports.Active && (c.Reports.Keep < 1) {
+		return errors.New("invalid number of saved abuse reports")
+	}
+	if err := c.Redirect.isValid(); err != nil {
+		return err
+	}
+	if c.Rules.Active && (c.Rules.Max < 1) {
+		return errors.New("invalid number of redirect rules")
+	}
+	if c.Privacy.Active {
+		if (c.Privacy.IPv4Mask < 1) || (c.Privacy.IPv4Mask > 32) {
+			return errors.New("invalid privacy IPv4 mask")
+		}
+		if (c.Privacy.IPv6Mask < 1) || (c.Privacy.IPv6Mask > 128) {
+			return errors.New("invalid privacy IPv6 mask")
 		}
-		if c.Rate.Interval < 1 {
-			return errors.New("invalid rate internal")
+		if c.Privacy.Hash && (c.Privacy.SaltTTL < 1) {
+			return errors.New("invalid privacy salt TTL")
+		}
+	}
+	if c.Analytics.Active {
+		if c.Analytics.Retention < 1 {
+			return errors.New("invalid analytics retention")
 		}
+		if c.Analytics.TopSize < 1 {
+			return errors.New("invalid analytics top size")
+		}
+	}
+	if c.Webhooks.Active {
+		if err := c.Webhooks.isValid(); err != nil {
+			return err
+		}
+	}
+	if err := c.Password.isValid(); err != nil {
+		return err
+	}
+	if err := c.TOTP.isValid(); err != nil {
+		return err
+	}
+	if err := c.Session.isValid(); err != nil {
+		return err
+	}
+	if err := c.Login.isValid(); err != nil {
+		return err
+	}
+	if err := c.Audit.isValid(); err != nil {
+		return err
 	}
 	static := strings.Trim(c.Static, " ")
 	if !filepath.IsAbs(static) {
@@ -199,9 +968,37 @@ func (c *Cfg) ShutdownTimeout() time.Duration {
 	return c.terminationTimeout
 }
 
+// ClientDataTTL returns TTL (seconds) for db records with clients' data,
+// it is limited by privacy retention period if it is set.
+func (c *Cfg) ClientDataTTL(ttl uint) uint {
+	if c.Privacy.Active && (c.Privacy.Retention > 0) && (c.Privacy.Retention < ttl) {
+		return c.Privacy.Retention
+	}
+	return ttl
+}
+
+// MetricsAddr returns net address of separate metrics service.
+// It is empty if metrics are exported by main service.
+func (c *Cfg) MetricsAddr() string {
+	if c.Metrics.Port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(c.Metrics.Host, fmt.Sprint(c.Metrics.Port))
+}
+
 // GetConn returns redis db connection.
 func (c *Cfg) GetConn() redis.Conn {
-	return c.pool.Get()
+	return &conn{c.pool.Get()}
+}
+
+// RedisActiveCount returns a number of active redis connections.
+func (c *Cfg) RedisActiveCount() int {
+	return c.pool.ActiveCount()
+}
+
+// RedisIdleCount returns a number of idle redis connections.
+func (c *Cfg) RedisIdleCount() int {
+	return c.pool.IdleCount()
 }
 
 // ShortURL returns short URL for configured site.
@@ -5,10 +5,18 @@
 package conf
 
 import (
+	"errors"
+	"net"
+	"net/http"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -16,6 +24,11 @@ const (
 	testConfigName = "config.example.json"
 )
 
+// validator is a settings section which is checked and gets default values.
+type validator interface {
+	isValid() error
+}
+
 func getConfig() string {
 	dirs := []string{os.Getenv("GOPATH"), "src"}
 	dirs = append(dirs, strings.Split(programRepo, "/")...)
@@ -36,3 +49,196 @@ func TestNew(t *testing.T) {
 		t.Error("empty address")
 	}
 }
+
+func TestRetryDelay(t *testing.T) {
+	wh := &webhooks{Backoff: 10}
+	items := map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		20: time.Hour,
+	}
+	for attempt, expected := range items {
+		if d := wh.RetryDelay(attempt); d != expected {
+			t.Errorf("unexpected delay for attempt %d: %v", attempt, d)
+		}
+	}
+}
+
+func TestPasswordCheck(t *testing.T) {
+	p := &passwords{MinLength: 8, Classes: 3}
+	items := map[string]bool{
+		"short1A":                 false,
+		"longpassword":            false,
+		"longpassword1":           false,
+		"Longpassword1":           true,
+		"long password 1":         true,
+		strings.Repeat("aA1", 25): false,
+	}
+	for password, expected := range items {
+		if err := p.Check(password); (err == nil) != expected {
+			t.Errorf("unexpected result for %q: %v", password, err)
+		}
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	l := &login{BaseDelay: 1, Lockout: 60}
+	items := map[int]uint{1: 1, 2: 2, 3: 4, 10: 60}
+	for n, expected := range items {
+		if d := l.Delay(n); d != expected {
+			t.Errorf("unexpected delay after %d failures: %v", n, d)
+		}
+	}
+	l.BaseDelay = 0
+	if d := l.Delay(5); d != 0 {
+		t.Errorf("unexpected disabled delay: %v", d)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	cases := []struct {
+		value    validator
+		expected validator
+	}{
+		{&passwords{}, &passwords{MinLength: 10, Cost: bcrypt.DefaultCost}},
+		{&twoFactor{}, &twoFactor{Issuer: "LRUSS", Skew: 1, Codes: 10}},
+		{&twoFactor{Issuer: "test", Codes: 5}, &twoFactor{Issuer: "test", Skew: 1, Codes: 5}},
+		{&twoFactor{Skew: -1}, &twoFactor{Issuer: "LRUSS", Codes: 10}},
+		{&session{}, &session{Idle: 3600, Absolute: 86400}},
+		{&login{}, &login{Attempts: 10, Window: 900, BaseDelay: 1, Lockout: 900}},
+		{&login{Attempts: 5}, &login{Attempts: 5, Window: 900, BaseDelay: 1, Lockout: 900}},
+		{&login{BaseDelay: -1}, &login{Attempts: 10, Window: 900, Lockout: 900}},
+		{&auditCfg{}, &auditCfg{Size: 10000, Retention: 365}},
+		{&urlPolicy{}, &urlPolicy{Schemes: []string{"http", "https"}, MaxLength: 2048}},
+		{&api{}, &api{KeyInterval: 60}},
+	}
+	for i, c := range cases {
+		if err := c.value.isValid(); err != nil {
+			t.Errorf("failed case [%v]: %v", i, err)
+		} else if !reflect.DeepEqual(c.value, c.expected) {
+			t.Errorf("failed case [%v]: %+v != %+v", i, c.value, c.expected)
+		}
+	}
+	invalid := []validator{
+		&passwords{MinLength: -1},
+		&twoFactor{Skew: 11},
+		&session{Idle: 600, Absolute: 60},
+		&login{Attempts: -1},
+		&login{BaseDelay: -2},
+		&auditCfg{Size: -1},
+		&urlPolicy{MaxLength: -1},
+	}
+	for i, value := range invalid {
+		if err := value.isValid(); err == nil {
+			t.Errorf("failed case [%v]: invalid settings are accepted", i)
+		}
+	}
+}
+
+func TestIsFailure(t *testing.T) {
+	items := map[error]bool{
+		redis.Error("NOSCRIPT No matching script. Please use EVAL."): false,
+		redis.Error("WRONGTYPE Operation against a key"):             true,
+		errors.New("connection refused"):                             true,
+	}
+	for err, expected := range items {
+		if isFailure(err) != expected {
+			t.Errorf("unexpected result for %v", err)
+		}
+	}
+	if isFailure(nil) {
+		t.Error("nil error is a failure")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	if _, err := parseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid network is parsed")
+	}
+	if _, err := parseNetworks([]string{"localhost"}); err == nil {
+		t.Error("invalid address is parsed")
+	}
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxies{networks: networks}
+	items := map[string]bool{
+		"10.1.2.3":        true,
+		"11.1.2.3":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"::ffff:10.0.0.1": true,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+	}
+	for value, expected := range items {
+		if p.IsTrusted(net.ParseIP(value)) != expected {
+			t.Errorf("unexpected result for %v", value)
+		}
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	l := &ipList{Deny: []string{"192.0.2.0/24"}}
+	if err := l.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Permits(net.ParseIP("192.0.2.1")) || !l.Permits(net.ParseIP("198.51.100.1")) {
+		t.Error("invalid deny list check")
+	}
+	l = &ipList{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.0.0.1"}}
+	if err := l.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	items := map[string]bool{
+		"10.1.2.3":    true,
+		"10.0.0.1":    false,
+		"192.0.2.1":   false,
+		"2001:db8::1": true,
+	}
+	for value, expected := range items {
+		if l.Permits(net.ParseIP(value)) != expected {
+			t.Errorf("unexpected result for %v", value)
+		}
+	}
+	r := &rate{IPv4Prefix: 24, IPv6Prefix: 64}
+	if ip := r.Aggregate(net.ParseIP("192.0.2.15")); ip.String() != "192.0.2.0" {
+		t.Errorf("unexpected IPv4 network %v", ip)
+	}
+	if ip := r.Aggregate(net.ParseIP("2001:db8:1:2:3:4:5:6")); ip.String() != "2001:db8:1:2::" {
+		t.Errorf("unexpected IPv6 network %v", ip)
+	}
+	r.IPv4Prefix = 0
+	if ip := r.Aggregate(net.ParseIP("192.0.2.15")); ip.String() != "192.0.2.15" {
+		t.Errorf("unexpected IPv4 address %v", ip)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	d := &redirect{}
+	if err := d.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != http.StatusFound {
+		t.Errorf("unexpected default status %v", d.Status)
+	}
+	items := []redirect{
+		{Status: http.StatusOK},
+		{Status: http.StatusSeeOther},
+		{Status: http.StatusMovedPermanently, ReferrerPolicy: "unknown"},
+	}
+	for i := range items {
+		if err := items[i].isValid(); err == nil {
+			t.Errorf("invalid settings are accepted %+v", items[i])
+		}
+	}
+	d = &redirect{Status: http.StatusPermanentRedirect, ReferrerPolicy: "no-referrer"}
+	if err := d.isValid(); err != nil {
+		t.Error(err)
+	}
+	if !IsPermanentRedirect(d.Status) || IsPermanentRedirect(http.StatusTemporaryRedirect) {
+		t.Error("invalid permanent redirect check")
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package link implements short links storage.
+// Destination URL is saved as "url:<short>" value,
+// other link's attributes are saved in "link:<short>" hash.
+// Owner's links are indexed by destination URL to prevent duplicates.
+package link
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/trim"
+)
+
+// maxUTM is a maximum length of campaign parameter.
+const maxUTM = 256
+
+// Modes of interstitial page.
+const (
+	// InterstitialOn shows the page for the link.
+	InterstitialOn = "on"
+	// InterstitialOff disables the page for the link.
+	InterstitialOff = "off"
+)
+
+var (
+	// ErrNotFound is an error of unknown short link.
+	ErrNotFound = errors.New("link not found")
+)
+
+// Options are link's redirect settings, zero values mean default behavior.
+type Options struct {
+	// Interstitial is a mode of "You are leaving" page.
+	Interstitial string `json:"interstitial,omitempty"`
+	// Status is HTTP status code of redirect.
+	Status int `json:"status,omitempty"`
+	// ReferrerPolicy is a value of Referrer-Policy header.
+	ReferrerPolicy string `json:"referrer_policy,omitempty"`
+	// PassQuery appends request's query parameters to destination URL.
+	PassQuery bool `json:"pass_query,omitempty"`
+	// PassPath appends request's path after short code to destination URL path.
+	PassPath bool `json:"pass_path,omitempty"`
+}
+
+// isValid checks the options.
+func (o *Options) isValid() error {
+	switch o.Interstitial {
+	case "", InterstitialOn, InterstitialOff:
+	default:
+		return errors.New("invalid interstitial mode")
+	}
+	if (o.Status != 0) && !conf.IsRedirectStatus(o.Status) {
+		return errors.New("invalid redirect status")
+	}
+	if !conf.IsReferrerPolicy(o.ReferrerPolicy) {
+		return errors.New("invalid referrer policy")
+	}
+	return nil
+}
+
+// UTM are campaign parameters, they are appended to destination URL at redirect.
+type UTM struct {
+	Source   string `json:"utm_source,omitempty"`
+	Medium   string `json:"utm_medium,omitempty"`
+	Campaign string `json:"utm_campaign,omitempty"`
+	Term     string `json:"utm_term,omitempty"`
+	Content  string `json:"utm_content,omitempty"`
+}
+
+// IsZero checks campaign parameters are not set.
+func (u *UTM) IsZero() bool {
+	return *u == UTM{}
+}
+
+// Validate checks campaign parameters, source, medium and campaign are required
+// if some parameter is set.
+func (u *UTM) Validate() error {
+	if u.IsZero() {
+		return nil
+	}
+	if (u.Source == "") || (u.Medium == "") || (u.Campaign == "") {
+		return errors.New("utm_source, utm_medium and utm_campaign are required")
+	}
+	for _, value := range []string{u.Source, u.Medium, u.Campaign, u.Term, u.Content} {
+		if len(value) > maxUTM {
+			return errors.New("too long campaign parameter")
+		}
+	}
+	return nil
+}
+
+// Values returns not empty campaign parameters.
+func (u *UTM) Values() url.Values {
+	values := url.Values{}
+	params := map[string]string{
+		"utm_source":   u.Source,
+		"utm_medium":   u.Medium,
+		"utm_campaign": u.Campaign,
+		"utm_term":     u.Term,
+		"utm_content":  u.Content,
+	}
+	for name, value := range params {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return values
+}
+
+// Link is a short link info.
+type Link struct {
+	Short   string    `json:"short"`
+	URL     string    `json:"url"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	// Disabled is a reason of disabled link, it's empty for active one.
+	Disabled string `json:"disabled,omitempty"`
+	// Whitelisted is a mark of the link checked by moderators, it's not disabled automatically.
+	Whitelisted bool `json:"whitelisted,omitempty"`
+	UTM         UTM  `json:"utm"`
+	Options
+}
+
+// links is a sortable list of links, newest first.
+type links []Link
+
+func (s links) Len() int      { return len(s) }
+func (s links) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s links) Less(i, j int) bool {
+	di, _ := trim.Decode(s[i].Short)
+	dj, _ := trim.Decode(s[j].Short)
+	return di > dj
+}
+
+// UserOwner returns an owner name of links created by user.
+func UserOwner(username string) string {
+	return "user:" + username
+}
+
+// KeyOwner returns an owner name of links created using API key.
+func KeyOwner(name string) string {
+	return "key:" + name
+}
+
+// destKey returns db key of owner's link index by destination URL and campaign parameters.
+func destKey(owner, originURL string, utm *UTM) (string, error) {
+	value := owner + " " + originURL
+	if !utm.IsZero() {
+		value += " " + utm.Values().Encode()
+	}
+	h := sha256.Sum256([]byte(value))
+	return conf.DbKey("dest", hex.EncodeToString(h[:]))
+}
+
+// Validate checks and returns destination URL.
+func Validate(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, errors.New("not url")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("invalid url")
+	}
+	if !u.IsAbs() {
+		return nil, errors.New("not absolute url")
+	}
+	return u, nil
+}
+
+// Save stores new short link.
+func Save(c redis.Conn, l *Link) error {
+	urlKey, err := conf.DbKey("url", l.Short)
+	if err != nil {
+		return err
+	}
+	linkKey, err := conf.DbKey("link", l.Short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SET", urlKey, l.URL)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HMSET", linkKey, "owner", l.Owner, "created", l.Created.Unix(),
+		"utm_source", l.UTM.Source, "utm_medium", l.UTM.Medium, "utm_campaign", l.UTM.Campaign,
+		"utm_term", l.UTM.Term, "utm_content", l.UTM.Content,
+	)
+	if err != nil {
+		return err
+	}
+	dest, err := destKey(l.Owner, l.URL, &l.UTM)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SET", dest, l.Short)
+	if err != nil {
+		return err
+	}
+	if l.Owner == "" {
+		return nil
+	}
+	ownerKey, err := conf.DbKey("owner", l.Owner)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SADD", ownerKey, l.Short)
+	return err
+}
+
+// Get returns a link by its short code.
+func Get(c redis.Conn, short string) (*Link, error) {
+	urlKey, err := conf.DbKey("url", short)
+	if err != nil {
+		return nil, err
+	}
+	linkKey, err := conf.DbKey("link", short)
+	if err != nil {
+		return nil, err
+	}
+	originURL, err := redis.String(c.Do("GET", urlKey))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Values(c.Do("HMGET", linkKey,
+		"owner", "created", "disabled", "whitelisted",
+		"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content",
+		"interstitial", "status", "referrer", "pass_query", "pass_path",
+	))
+	if err != nil {
+		return nil, err
+	}
+	var created int64
+	l := &Link{Short: short, URL: originURL}
+	_, err = redis.Scan(values,
+		&l.Owner, &created, &l.Disabled, &l.Whitelisted,
+		&l.UTM.Source, &l.UTM.Medium, &l.UTM.Campaign, &l.UTM.Term, &l.UTM.Content,
+		&l.Interstitial, &l.Status, &l.ReferrerPolicy, &l.PassQuery, &l.PassPath,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if created > 0 {
+		l.Created = time.Unix(created, 0).UTC()
+	}
+	return l, nil
+}
+
+// Update changes destination URL of the link.
+func Update(c redis.Conn, short, originURL string) error {
+	urlKey, err := conf.DbKey("url", short)
+	if err != nil {
+		return err
+	}
+	_, err = redis.String(c.Do("SET", urlKey, originURL, "XX"))
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	linkKey, err := conf.DbKey("link", short)
+	if err != nil {
+		return err
+	}
+	values, err := redis.Values(c.Do("HMGET", linkKey,
+		"owner", "utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content",
+	))
+	if err != nil {
+		return err
+	}
+	var (
+		owner string
+		utm   UTM
+	)
+	_, err = redis.Scan(values, &owner, &utm.Source, &utm.Medium, &utm.Campaign, &utm.Term, &utm.Content)
+	if err != nil {
+		return err
+	}
+	dest, err := destKey(owner, originURL, &utm)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SET", dest, short)
+	return err
+}
+
+// isPlain checks the link has default options, no redirect rules
+// and it isn't in abuse reports moderation queue.
+func isPlain(c redis.Conn, l *Link) (bool, error) {
+	if l.Options != (Options{}) {
+		return false, nil
+	}
+	rulesKey, err := conf.DbKey("rules", l.Short)
+	if err != nil {
+		return false, err
+	}
+	n, err := redis.Int(c.Do("EXISTS", rulesKey))
+	if (err != nil) || (n > 0) {
+		return false, err
+	}
+	queueKey, err := conf.DbKey("report", "queue")
+	if err != nil {
+		return false, err
+	}
+	_, err = redis.Int(c.Do("ZSCORE", queueKey, l.Short))
+	if err == redis.ErrNil {
+		return true, nil
+	}
+	return false, err
+}
+
+// Find returns active owner's link with the destination URL and campaign parameters.
+// Only plain links are returned, so changed options or rules of a found link
+// don't affect new requests.
+func Find(c redis.Conn, owner, originURL string, utm *UTM) (*Link, error) {
+	dest, err := destKey(owner, originURL, utm)
+	if err != nil {
+		return nil, err
+	}
+	short, err := redis.String(c.Do("GET", dest))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	l, err := Get(c, short)
+	if err != nil {
+		return nil, err
+	}
+	// the index can be outdated after link's change
+	if (l.URL != originURL) || (l.Owner != owner) || (l.UTM != *utm) || (l.Disabled != "") {
+		return nil, ErrNotFound
+	}
+	plain, err := isPlain(c, l)
+	if err != nil {
+		return nil, err
+	}
+	if !plain {
+		return nil, ErrNotFound
+	}
+	return l, nil
+}
+
+// exists returns ErrNotFound if the link doesn't exist.
+func exists(c redis.Conn, short string) error {
+	urlKey, err := conf.DbKey("url", short)
+	if err != nil {
+		return err
+	}
+	n, err := redis.Int(c.Do("EXISTS", urlKey))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Disable marks the link as disabled with a reason, it's not used for redirects.
+func Disable(c redis.Conn, short, reason string) error {
+	if err := exists(c, short); err != nil {
+		return err
+	}
+	linkKey, err := conf.DbKey("link", short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", linkKey, "disabled", reason)
+	return err
+}
+
+// SetOptions changes redirect settings of the link.
+func SetOptions(c redis.Conn, short string, o *Options) error {
+	if err := o.isValid(); err != nil {
+		return err
+	}
+	if err := exists(c, short); err != nil {
+		return err
+	}
+	linkKey, err := conf.DbKey("link", short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HMSET", linkKey,
+		"interstitial", o.Interstitial, "status", o.Status, "referrer", o.ReferrerPolicy,
+		"pass_query", o.PassQuery, "pass_path", o.PassPath,
+	)
+	return err
+}
+
+// Enable removes disabled mark of the link.
+func Enable(c redis.Conn, short string) error {
+	linkKey, err := conf.DbKey("link", short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HDEL", linkKey, "disabled")
+	return err
+}
+
+// Whitelist enables the link and marks it as checked by moderators.
+func Whitelist(c redis.Conn, short string) error {
+	if err := exists(c, short); err != nil {
+		return err
+	}
+	linkKey, err := conf.DbKey("link", short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HDEL", linkKey, "disabled")
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", linkKey, "whitelisted", 1)
+	return err
+}
+
+// Delete removes the link.
+func Delete(c redis.Conn, l *Link) error {
+	urlKey, err := conf.DbKey("url", l.Short)
+	if err != nil {
+		return err
+	}
+	linkKey, err := conf.DbKey("link", l.Short)
+	if err != nil {
+		return err
+	}
+	rulesKey, err := conf.DbKey("rules", l.Short)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("DEL", urlKey, linkKey, rulesKey)
+	if err != nil {
+		return err
+	}
+	dest, err := destKey(l.Owner, l.URL, &l.UTM)
+	if err != nil {
+		return err
+	}
+	indexed, err := redis.String(c.Do("GET", dest))
+	if (err != nil) && (err != redis.ErrNil) {
+		return err
+	}
+	if indexed == l.Short {
+		_, err = c.Do("DEL", dest)
+		if err != nil {
+			return err
+		}
+	}
+	if l.Owner == "" {
+		return nil
+	}
+	ownerKey, err := conf.DbKey("owner", l.Owner)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SREM", ownerKey, l.Short)
+	return err
+}
+
+// shorts returns short codes of owner's links or all ones if owner is empty.
+func shorts(c redis.Conn, owner string) ([]string, error) {
+	if owner != "" {
+		ownerKey, err := conf.DbKey("owner", owner)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Strings(c.Do("SMEMBERS", ownerKey))
+	}
+	pattern, err := conf.DbKey("url", "*")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := redis.Strings(c.Do("KEYS", pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = key[len(pattern)-1:]
+	}
+	return keys, nil
+}
+
+// List returns owner's links (all ones if owner is empty),
+// which short code or destination URL contain query substring.
+func List(c redis.Conn, owner, query string) ([]Link, error) {
+	items, err := shorts(c, owner)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	result := make(links, 0, len(items))
+	for _, short := range items {
+		l, err := Get(c, short)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if (query == "") || strings.Contains(strings.ToLower(l.URL), query) || strings.Contains(strings.ToLower(l.Short), query) ||
+			strings.Contains(strings.ToLower(l.UTM.Campaign), query) {
+			result = append(result, *l)
+		}
+	}
+	sort.Sort(result)
+	return result, nil
+}
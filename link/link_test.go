@@ -0,0 +1,352 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package link
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	items := map[string]bool{
+		"":                    false,
+		"/path":               false,
+		"%zz":                 false,
+		"https://example.com": true,
+	}
+	for rawURL, expected := range items {
+		if _, err := Validate(rawURL); (err == nil) != expected {
+			t.Errorf("unexpected result for %q: %v", rawURL, err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	strip := []string{"utm_*", "fbclid"}
+	items := map[string]string{
+		"HTTPS://Example.COM":                           "https://example.com/",
+		"http://example.com:80/a?":                      "http://example.com/a",
+		"https://example.com:443/a#":                    "https://example.com/a",
+		"https://example.com:8443/a":                    "https://example.com:8443/a",
+		"http://example.com./%7euser/%2f%c3%a9":         "http://example.com/~user/%2F%C3%A9",
+		"https://пример.рф/путь":                        "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C",
+		"https://xn--e1afmkfd.xn--p1ai/":                "https://xn--e1afmkfd.xn--p1ai/",
+		"https://example.com/?b=1&utm_source=x&&a=%7e2": "https://example.com/?b=1&a=~2",
+		"https://example.com/?UTM_Medium=x&fbclid=y":    "https://example.com/",
+		"https://example.com/#Sec%74ion":                "https://example.com/#Section",
+		"http://[2001:DB8::1]:80/":                      "http://[2001:db8::1]/",
+		"https://user@Example.com:443/":                 "https://user@example.com/",
+		"MAILTO:User@Example.com":                       "mailto:User@Example.com",
+	}
+	for rawURL, expected := range items {
+		u, err := Validate(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := Normalize(u, strip)
+		if err != nil {
+			t.Errorf("failed normalization of %q: %v", rawURL, err)
+			continue
+		}
+		if v.String() != expected {
+			t.Errorf("unexpected result for %q: %v", rawURL, v)
+		}
+	}
+	u, err := Validate("https://exa\u2024mple.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Normalize(u, nil); err == nil {
+		t.Error("invalid host is normalized")
+	}
+}
+
+func TestLinks(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	items := []Link{
+		{Short: "1", URL: "https://example.com/a", Owner: UserOwner("test"), Created: now},
+		{Short: "2", URL: "https://example.com/b", Owner: KeyOwner("test"), Created: now},
+		{Short: "3", URL: "https://example.org/c", Owner: UserOwner("test"), Created: now},
+	}
+	for i := range items {
+		if err := Save(c, &items[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := Get(c, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *l != items[1] {
+		t.Errorf("unexpected link %+v", l)
+	}
+	if _, err = Get(c, "4"); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	result, err := List(c, UserOwner("test"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(result) != 2) || (result[0].Short != "3") || (result[1].Short != "1") {
+		t.Errorf("unexpected links %v", result)
+	}
+	result, err = List(c, "", "EXAMPLE.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(result) != 2) || (result[0].Short != "2") {
+		t.Errorf("unexpected links %v", result)
+	}
+	if err = Update(c, "1", "https://example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Update(c, "4", "https://example.net"); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = Delete(c, &items[2]); err != nil {
+		t.Fatal(err)
+	}
+	result, err = List(c, UserOwner("test"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(result) != 1) || (result[0].URL != "https://example.net") {
+		t.Errorf("unexpected links %v", result)
+	}
+	if err = Disable(c, "1", "test reason"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Disable(c, "3", "test reason"); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	if l, err = Get(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if l.Disabled != "test reason" {
+		t.Errorf("link is not disabled %+v", l)
+	}
+	if err = Enable(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Get(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if l.Disabled != "" {
+		t.Errorf("link is not enabled %+v", l)
+	}
+	if err = SetOptions(c, "1", &Options{Interstitial: "unknown"}); err == nil {
+		t.Error("invalid options are saved")
+	}
+	if err = SetOptions(c, "3", &Options{}); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = SetOptions(c, "1", &Options{Status: 303}); err == nil {
+		t.Error("invalid status is saved")
+	}
+	options := Options{Interstitial: InterstitialOn, Status: 301, ReferrerPolicy: "origin", PassPath: true}
+	if err = SetOptions(c, "1", &options); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Get(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if l.Options != options {
+		t.Errorf("options are not saved %+v", l)
+	}
+	if err = Disable(c, "1", "test reason"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Whitelist(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Get(c, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Whitelisted || (l.Disabled != "") {
+		t.Errorf("link is not whitelisted %+v", l)
+	}
+	if err = Whitelist(c, "3"); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	owner := UserOwner("test")
+	l := &Link{Short: "1", URL: "https://example.com/", Owner: owner, Created: time.Now().UTC()}
+	if err := Save(c, l); err != nil {
+		t.Fatal(err)
+	}
+	found, err := Find(c, owner, l.URL, &l.UTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Short != l.Short {
+		t.Errorf("unexpected link %+v", found)
+	}
+	if _, err = Find(c, "", l.URL, &l.UTM); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = Update(c, l.Short, "https://example.org/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Find(c, owner, l.URL, &l.UTM); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	if found, err = Find(c, owner, "https://example.org/", &l.UTM); (err != nil) || (found.Short != l.Short) {
+		t.Errorf("unexpected result %+v: %v", found, err)
+	}
+	// customized links are not reused
+	changes := []struct{ set, reset []interface{} }{
+		{
+			[]interface{}{"SET", "rules:1", `[{"target":"https://example.net/"}]`},
+			[]interface{}{"DEL", "rules:1"},
+		},
+		{
+			[]interface{}{"ZADD", "report:queue", 1, "1"},
+			[]interface{}{"DEL", "report:queue"},
+		},
+		{
+			[]interface{}{"HSET", "link:1", "status", 301},
+			[]interface{}{"HSET", "link:1", "status", 0},
+		},
+	}
+	for i, change := range changes {
+		if _, err = c.Do(change.set[0].(string), change.set[1:]...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Find(c, owner, "https://example.org/", &l.UTM); err != ErrNotFound {
+			t.Errorf("failed case [%v]: unexpected error %v", i, err)
+		}
+		if _, err = c.Do(change.reset[0].(string), change.reset[1:]...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Find(c, owner, "https://example.org/", &l.UTM); err != nil {
+			t.Errorf("failed case [%v]: unexpected error %v", i, err)
+		}
+	}
+	if err = Disable(c, l.Short, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Find(c, owner, "https://example.org/", &l.UTM); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	found.URL = "https://example.org/"
+	if err = Delete(c, found); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := redis.Strings(c.Do("KEYS", "dest:*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		// only outdated index of the first URL
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
+
+func TestUTM(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	invalid := []UTM{
+		{Source: "news"},
+		{Source: "news", Medium: "email", Content: "top"},
+		{Source: "news", Medium: "email", Campaign: strings.Repeat("a", maxUTM+1)},
+	}
+	for i, utm := range invalid {
+		if err := utm.Validate(); err == nil {
+			t.Errorf("failed case [%v]: expected error", i)
+		}
+	}
+	utm := UTM{Source: "news", Medium: "email", Campaign: "spring sale"}
+	if err := utm.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if v := utm.Values().Encode(); v != "utm_campaign=spring+sale&utm_medium=email&utm_source=news" {
+		t.Errorf("unexpected values %v", v)
+	}
+	owner := UserOwner("test")
+	plain := &Link{Short: "1", URL: "https://example.com/", Owner: owner, Created: time.Now().UTC()}
+	tagged := &Link{Short: "2", URL: plain.URL, Owner: owner, Created: time.Now().UTC(), UTM: utm}
+	for _, l := range []*Link{plain, tagged} {
+		if err := Save(c, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := Get(c, tagged.Short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.UTM != utm {
+		t.Errorf("unexpected campaign %+v", l.UTM)
+	}
+	if l, err = Find(c, owner, plain.URL, &UTM{}); (err != nil) || (l.Short != plain.Short) {
+		t.Errorf("unexpected result %+v: %v", l, err)
+	}
+	if l, err = Find(c, owner, plain.URL, &utm); (err != nil) || (l.Short != tagged.Short) {
+		t.Errorf("unexpected result %+v: %v", l, err)
+	}
+	other := UTM{Source: "news", Medium: "email", Campaign: "autumn"}
+	if _, err = Find(c, owner, plain.URL, &other); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	items, err := List(c, "", "SPRING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(items) != 1) || (items[0].Short != tagged.Short) {
+		t.Errorf("unexpected links %v", items)
+	}
+}
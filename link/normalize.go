@@ -0,0 +1,164 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package link
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	// profile converts internationalized domain names to ASCII,
+	// underscores are allowed because they are used in real hosts names.
+	profile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+	// defaultPorts are default ports of known schemes.
+	defaultPorts = map[string]string{"http": "80", "https": "443", "ftp": "21"}
+)
+
+// Host returns normalized host name: lower case ASCII without trailing dot,
+// internationalized domain names are converted to punycode.
+func Host(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if (host == "") || (net.ParseIP(host) != nil) {
+		return host, nil
+	}
+	ascii, err := profile.ToASCII(host)
+	if err != nil {
+		return "", errors.New("invalid host name")
+	}
+	return ascii, nil
+}
+
+// isUnreserved checks the byte is an unreserved URL character (RFC 3986).
+func isUnreserved(b byte) bool {
+	switch {
+	case ('a' <= b) && (b <= 'z'), ('A' <= b) && (b <= 'Z'), ('0' <= b) && (b <= '9'):
+		return true
+	}
+	return strings.IndexByte("-._~", b) >= 0
+}
+
+// unhex returns a value of hexadecimal digit or -1.
+func unhex(b byte) int {
+	switch {
+	case ('0' <= b) && (b <= '9'):
+		return int(b - '0')
+	case ('a' <= b) && (b <= 'f'):
+		return int(b-'a') + 10
+	case ('A' <= b) && (b <= 'F'):
+		return int(b-'A') + 10
+	}
+	return -1
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters
+// and uses upper case hexadecimal digits for other ones.
+func normalizeEscapes(s string) string {
+	if strings.IndexByte(s, '%') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if (s[i] == '%') && (i+2 < len(s)) {
+			h, l := unhex(s[i+1]), unhex(s[i+2])
+			if (h >= 0) && (l >= 0) {
+				if c := byte(h<<4 | l); isUnreserved(c) {
+					b.WriteByte(c)
+				} else {
+					b.WriteString(strings.ToUpper(s[i : i+3]))
+				}
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isStripped checks the query parameter matches one of patterns,
+// a pattern with trailing "*" matches parameters with its prefix.
+func isStripped(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.ToLower(pattern[:len(pattern)-1])) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeQuery removes empty and stripped parameters, others keep their order.
+func normalizeQuery(query string, strip []string) string {
+	var params []string
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if name, err := url.QueryUnescape(name); (err == nil) && isStripped(name, strip) {
+			continue
+		}
+		params = append(params, normalizeEscapes(param))
+	}
+	return strings.Join(params, "&")
+}
+
+// Normalize returns a canonical form of absolute URL: lower case scheme and host,
+// punycode domain name, without default port, empty query and fragment,
+// with normalized percent-encoding. Query parameters matching strip patterns are removed.
+func Normalize(u *url.URL, strip []string) (*url.URL, error) {
+	v := *u
+	v.Scheme = strings.ToLower(v.Scheme)
+	if v.Opaque != "" {
+		return &v, nil
+	}
+	if v.Host != "" {
+		host, err := Host(v.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		port := v.Port()
+		if port == defaultPorts[v.Scheme] {
+			port = ""
+		}
+		switch {
+		case port != "":
+			v.Host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			v.Host = "[" + host + "]"
+		default:
+			v.Host = host
+		}
+	}
+	path := normalizeEscapes(v.EscapedPath())
+	if (path == "") && (v.Host != "") {
+		path = "/"
+	}
+	p, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, errors.New("invalid url path")
+	}
+	v.Path, v.RawPath = p, path
+	v.RawQuery = normalizeQuery(v.RawQuery, strip)
+	v.ForceQuery = false
+	fragment := normalizeEscapes(v.EscapedFragment())
+	if v.Fragment, err = url.PathUnescape(fragment); err != nil {
+		return nil, errors.New("invalid url fragment")
+	}
+	v.RawFragment = fragment
+	return &v, nil
+}
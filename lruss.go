@@ -6,9 +6,12 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -18,10 +21,21 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/z0rr0/lruss/access"
 	"github.com/z0rr0/lruss/admin"
+	"github.com/z0rr0/lruss/analytics"
+	"github.com/z0rr0/lruss/apikey"
+	"github.com/z0rr0/lruss/audit"
+	"github.com/z0rr0/lruss/blocklist"
 	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/metrics"
+	"github.com/z0rr0/lruss/policy"
+	"github.com/z0rr0/lruss/privacy"
+	"github.com/z0rr0/lruss/ratelimit"
+	"github.com/z0rr0/lruss/rules"
 	"github.com/z0rr0/lruss/trim"
 	"github.com/z0rr0/lruss/web"
+	"github.com/z0rr0/lruss/webhook"
 )
 
 const (
@@ -33,11 +47,12 @@ const (
 	interruptPrefix = "interrupt signal"
 )
 
-// methodHandler is HTTP method handler structure.
+// methodHandler is HTTP method handler structure,
+// Role is a minimal user's role to get access, admin.RoleNone allows anonymous requests.
 type methodHandler struct {
-	Func         func(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error)
-	Method       string
-	AuthRequired bool
+	Func   func(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error)
+	Method string
+	Role   admin.Role
 }
 
 var (
@@ -64,6 +79,143 @@ func interrupt(errc chan error) {
 	errc <- fmt.Errorf("%v %v", interruptPrefix, <-c)
 }
 
+// saveRequest registers handled request in daily statistics.
+func saveRequest(cfg *conf.Cfg, code int) error {
+	c := cfg.GetConn()
+	defer c.Close()
+	return analytics.Request(c, cfg, code)
+}
+
+// checkAccess checks that request's client can use the path.
+func checkAccess(cfg *conf.Cfg, path string, r *http.Request) (int, error) {
+	c := cfg.GetConn()
+	defer c.Close()
+
+	allowed, err := access.Check(c, cfg, path, r)
+	if err != nil {
+		loggerError.Printf("access check error: %v", err)
+		return conf.HTTPError(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return conf.HTTPError(http.StatusForbidden)
+	}
+	return http.StatusOK, nil
+}
+
+// limitRate checks rate limit of the route for request's client and sets limit headers.
+func limitRate(cfg *conf.Cfg, route string, w http.ResponseWriter, r *http.Request) (int, error) {
+	c := cfg.GetConn()
+	defer c.Close()
+
+	result, err := ratelimit.Check(c, cfg, route, r)
+	if err != nil {
+		loggerError.Printf("rate limit error: %v", err)
+		return conf.HTTPError(http.StatusInternalServerError)
+	}
+	if result == nil {
+		return http.StatusOK, nil
+	}
+	ratelimit.SetHeaders(w, result)
+	if !result.Allowed {
+		metrics.RateRejections.Inc()
+		return conf.HTTPError(http.StatusTooManyRequests)
+	}
+	return http.StatusOK, nil
+}
+
+// checkCSRF verifies CSRF token of POST request. Only requests of API routes
+// with valid API key don't use cookies, so they are not checked.
+func checkCSRF(ctx context.Context, cfg *conf.Cfg, path string, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusOK, nil
+	}
+	if access.RouteArea(path) == access.API {
+		c := cfg.GetConn()
+		key, err := apikey.FromRequest(c, r)
+		c.Close()
+		if (err != nil) && (err != apikey.ErrInvalid) {
+			loggerError.Printf("API key error: %v", err)
+			return conf.HTTPError(http.StatusInternalServerError)
+		}
+		if key != nil {
+			return http.StatusOK, nil
+		}
+	}
+	isValid, err := admin.CheckCSRF(ctx, r.PostFormValue(admin.CSRFTokenName))
+	if err != nil {
+		loggerError.Printf("CSRF check error: %v", err)
+		return conf.HTTPError(http.StatusInternalServerError)
+	}
+	if !isValid {
+		loggerError.Println("invalid CSRF token")
+		return conf.HTTPError(http.StatusBadRequest)
+	}
+	return http.StatusOK, nil
+}
+
+// saveEvent registers the request's event in the audit log.
+func saveEvent(cfg *conf.Cfg, e *audit.Event, code int) error {
+	c := cfg.GetConn()
+	defer c.Close()
+	e.Code = code
+	return audit.Record(c, cfg, e)
+}
+
+// recordCLI registers command line action in the audit log.
+func recordCLI(cfg *conf.Cfg, action, target string) error {
+	c := cfg.GetConn()
+	defer c.Close()
+	return audit.Record(c, cfg, &audit.Event{Actor: audit.CLI, Action: action, Target: target})
+}
+
+// readPassword reads a password from the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if (err != nil) && (err != io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+// setRole changes user's role.
+func setRole(cfg *conf.Cfg, username, roleName string) error {
+	role, err := admin.ParseRole(roleName)
+	if err != nil {
+		return err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+	return admin.SetRole(c, username, role)
+}
+
+// manageKeys creates or revokes API keys.
+func manageKeys(cfg *conf.Cfg, name, revoke string, rate, quota int64) error {
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if revoke != "" {
+		if err := apikey.Revoke(c, revoke); err != nil {
+			return err
+		}
+		fmt.Printf("API key '%v' is revoked\n", revoke)
+		return recordCLI(cfg, "apikey.revoke", revoke)
+	}
+	token, err := apikey.Create(c, name, rate, quota)
+	if err != nil {
+		return err
+	}
+	err = recordCLI(cfg, "apikey.create", name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("API key '%v' is created, value is '%v'\n", name, token)
+	return nil
+}
+
 func main() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -73,6 +225,12 @@ func main() {
 	version := flag.Bool("version", false, "show version")
 	config := flag.String("config", Config, "configuration file")
 	adminPass := flag.String("adminpass", "", "create or update admin credentials")
+	stdinPass := flag.Bool("stdinpass", false, "read a password for -adminpass from stdin instead of generation")
+	role := flag.String("role", "", "set user's role with -adminpass: viewer, editor or admin")
+	newKey := flag.String("apikey", "", "create API key with a name")
+	keyRate := flag.Int64("keyrate", 0, "API key rate limit, links per API key interval (0 - unlimited)")
+	keyQuota := flag.Int64("keyquota", 0, "API key total links quota (0 - unlimited)")
+	revokeKey := flag.String("revokekey", "", "revoke API key by its name")
 	flag.Parse()
 
 	if *version {
@@ -97,18 +255,71 @@ func main() {
 		}
 	}()
 	if *adminPass != "" {
-		password, created, err := admin.CreateOrUpdate(cfg, *adminPass)
+		var password string
+		if *stdinPass {
+			password, err = readPassword(os.Stdin)
+			if err != nil {
+				loggerError.Fatal(err)
+			}
+		}
+		password, created, err := admin.CreateOrUpdate(cfg, *adminPass, password)
 		if err != nil {
 			loggerError.Fatal(err)
 		}
+		action := "password.change"
 		if created {
+			action = "user.create"
+		}
+		if err := recordCLI(cfg, action, "user:"+*adminPass); err != nil {
+			loggerError.Fatal(err)
+		}
+		if *role != "" {
+			if err := setRole(cfg, *adminPass, *role); err != nil {
+				loggerError.Fatal(err)
+			}
+			if err := recordCLI(cfg, "user.role", "user:"+*adminPass); err != nil {
+				loggerError.Fatal(err)
+			}
+		}
+		switch {
+		case *stdinPass && created:
+			fmt.Printf("user '%v' is created\n", *adminPass)
+		case *stdinPass:
+			fmt.Printf("password of user '%v' is updated\n", *adminPass)
+		case created:
 			fmt.Printf("user '%v' is created, password is '%v'\n", *adminPass, password)
-		} else {
+		default:
 			fmt.Printf("password of user '%v' is updated, new value is '%v'\n", *adminPass, password)
 		}
 		return
 	}
+	if (*newKey != "") || (*revokeKey != "") {
+		if err := manageKeys(cfg, *newKey, *revokeKey, *keyRate, *keyQuota); err != nil {
+			loggerError.Fatal(err)
+		}
+		return
+	}
 
+	err = policy.Load(cfg)
+	if err != nil {
+		loggerError.Fatalf("URL policy: %v", err)
+	}
+	if cfg.Blocklist.Active {
+		err = blocklist.Load(cfg)
+		if err != nil {
+			loggerError.Fatalf("blocklist: %v", err)
+		}
+		hosts, prefixes := blocklist.Size()
+		loggerInfo.Printf("blocklist: %d hosts, %d URL prefixes\n", hosts, prefixes)
+	}
+	if cfg.Rules.Active {
+		err = rules.Load(cfg)
+		if err != nil {
+			loggerError.Fatalf("GeoIP: %v", err)
+		}
+		loggerInfo.Printf("GeoIP: %d networks\n", rules.Size())
+	}
+	web.LoggerError = loggerError
 	err = web.ResetTplCache(cfg)
 	if err != nil {
 		loggerError.Fatalf("template cache reset: %v", err)
@@ -128,53 +339,135 @@ func main() {
 		http.FileServer(http.Dir(cfg.Static))),
 	)
 	handlers := map[string]methodHandler{
-		"":             {web.HandleHTML, "ANY", false},
-		"api/add":      {web.HandleAPI, "ANY", false},
-		"admin/login":  {admin.Login, "ANY", false},
-		"admin/logout": {admin.Logout, "POST", false},
-		"admin/index":  {admin.Index, "GET", true},
-		"admin/export": {admin.Export, "GET", true},
+		"":             {web.HandleHTML, "ANY", admin.RoleNone},
+		"api/add":      {web.HandleAPI, "ANY", admin.RoleNone},
+		"api/links":    {web.HandleLinks, "GET", admin.RoleNone},
+		"api/delete":   {web.HandleDelete, "POST", admin.RoleNone},
+		"admin/login":  {admin.Login, "ANY", admin.RoleNone},
+		"admin/logout": {admin.Logout, "POST", admin.RoleNone},
+		"admin/index":  {admin.Index, "GET", admin.RoleViewer},
+		"admin/export": {admin.Export, "GET", admin.RoleEditor},
+		"admin/purge":  {admin.Purge, "POST", admin.RoleAdmin},
+		"admin/stats":  {admin.Stats, "GET", admin.RoleViewer},
+		"admin/unlock": {admin.Unlock, "POST", admin.RoleAdmin},
+
+		"api/ratelimit": {web.HandleRateLimit, "GET", admin.RoleNone},
+
+		"admin/links":         {admin.Links, "GET", admin.RoleViewer},
+		"admin/links/edit":    {admin.EditLink, "POST", admin.RoleEditor},
+		"admin/links/options": {admin.LinkOptions, "ANY", admin.RoleEditor},
+		"admin/links/rules":   {admin.LinkRules, "ANY", admin.RoleEditor},
+		"admin/links/delete":  {admin.DeleteLink, "POST", admin.RoleEditor},
+		"admin/links/enable":  {admin.EnableLink, "POST", admin.RoleAdmin},
+
+		"admin/keys":        {admin.Keys, "ANY", admin.RoleAdmin},
+		"admin/keys/revoke": {admin.RevokeKey, "POST", admin.RoleAdmin},
+
+		"admin/users":        {admin.Users, "ANY", admin.RoleAdmin},
+		"admin/users/update": {admin.UpdateUser, "POST", admin.RoleAdmin},
+		"admin/password":     {admin.ChangePassword, "ANY", admin.RoleViewer},
+		"admin/totp":         {admin.TwoFactor, "ANY", admin.RoleViewer},
+
+		"admin/sessions":        {admin.Sessions, "GET", admin.RoleViewer},
+		"admin/sessions/revoke": {admin.RevokeSession, "POST", admin.RoleViewer},
+
+		"admin/webhooks":         {admin.Webhooks, "GET", admin.RoleAdmin},
+		"admin/webhooks/requeue": {admin.RequeueWebhooks, "POST", admin.RoleAdmin},
+
+		"admin/audit":        {admin.Audit, "GET", admin.RoleAdmin},
+		"admin/audit/export": {admin.ExportAudit, "GET", admin.RoleAdmin},
+
+		"admin/bans":        {admin.Bans, "ANY", admin.RoleAdmin},
+		"admin/bans/remove": {admin.Unban, "POST", admin.RoleAdmin},
+
+		"report":                 {web.HandleReport, "ANY", admin.RoleNone},
+		"admin/reports":          {admin.Reports, "GET", admin.RoleAdmin},
+		"admin/reports/moderate": {admin.ModerateLink, "POST", admin.RoleAdmin},
+	}
+	var metricsServer *http.Server
+	if cfg.Metrics.Active {
+		metrics.NewGaugeFunc("lruss_redis_pool_active_connections",
+			"Number of active redis connections.",
+			func() float64 { return float64(cfg.RedisActiveCount()) },
+		)
+		metrics.NewGaugeFunc("lruss_redis_pool_idle_connections",
+			"Number of idle redis connections.",
+			func() float64 { return float64(cfg.RedisIdleCount()) },
+		)
+		if addr := cfg.MetricsAddr(); addr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			metricsServer = &http.Server{
+				Addr:     addr,
+				Handler:  mux,
+				ErrorLog: loggerError,
+			}
+		} else {
+			handlers["metrics"] = methodHandler{metrics.Handle, "GET", admin.RoleNone}
+		}
 	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		start, code := time.Now(), http.StatusOK
+		var (
+			err   error
+			event *audit.Event
+		)
+		start, code, route := time.Now(), http.StatusOK, "unknown"
 		defer func() {
 			if err != nil {
 				http.Error(w, err.Error(), code)
 			}
+			// authenticated requests and annotated events
+			if (event != nil) && (event.Action != "") {
+				if err := saveEvent(cfg, event, code); err != nil {
+					loggerError.Printf("audit error: %v", err)
+				}
+			}
+			duration := time.Since(start)
+			metrics.Requests.Inc(route, fmt.Sprint(code))
+			metrics.Durations.Observe(duration.Seconds(), route, fmt.Sprint(code))
+			if err := saveRequest(cfg, code); err != nil {
+				loggerError.Printf("analytics error: %v", err)
+			}
 			loggerInfo.Printf("%-5v %v\t%-12v\t%v",
 				r.Method,
 				code,
-				time.Since(start),
+				duration,
 				r.URL.String(),
 			)
 		}()
 		path := strings.Trim(r.URL.Path, "/ ")
+		if code, err = checkAccess(cfg, path, r); err != nil {
+			return
+		}
 		handler, ok := handlers[path]
 		if ok {
+			route = "/" + path
 			if (r.Method != handler.Method) && (handler.Method != "ANY") {
 				code, err = conf.HTTPError(http.StatusMethodNotAllowed)
 				return
 			}
-			ctx, authErr := admin.Auth(mainCtx, r)
-			if handler.AuthRequired && (authErr != nil) {
-				loggerError.Printf("auth error: %v", authErr)
-				code = http.StatusFound
-				http.Redirect(w, r, "/admin/login/", code)
+			if code, err = limitRate(cfg, route, w, r); err != nil {
 				return
 			}
-			if r.Method == "POST" {
-				isValid, err := admin.CheckCSRF(ctx, r.PostFormValue(admin.CSRFTokenName))
-				if err != nil {
-					code, err = conf.HTTPError(http.StatusInternalServerError)
+			ctx, authErr := admin.Auth(mainCtx, r)
+			event = &audit.Event{Actor: admin.GetContext(ctx), IP: privacy.RemoteIP(cfg, r)}
+			ctx = audit.SetContext(ctx, event)
+			if handler.Role != admin.RoleNone {
+				if authErr != nil {
+					loggerError.Printf("auth error: %v", authErr)
+					code, event = http.StatusFound, nil
+					http.Redirect(w, r, "/admin/login/", code)
 					return
 				}
-				if !isValid {
-					loggerError.Println("invalid CSRF token")
-					code, err = conf.HTTPError(http.StatusBadRequest)
+				event.Action = route
+				if !admin.HasRole(ctx, handler.Role) {
+					code, err = conf.HTTPError(http.StatusForbidden)
 					return
 				}
 			}
+			if code, err = checkCSRF(ctx, cfg, path, r); err != nil {
+				return
+			}
 			code, err = handler.Func(ctx, w, r)
 			if err != nil {
 				loggerError.Printf("handler error: %v", err)
@@ -185,8 +478,12 @@ func main() {
 			}
 			return
 		}
-		if trim.IsShort(path) {
-			ctx := web.SetContext(mainCtx, path)
+		if short := web.ShortCode(path); trim.IsShort(short) {
+			route = "redirect"
+			if code, err = limitRate(cfg, route, w, r); err != nil {
+				return
+			}
+			ctx := web.SetContext(mainCtx, short)
 			code, err = web.HandleRedirect(ctx, w, r)
 			if err != nil {
 				loggerInfo.Printf("redirect handler error: %v", err)
@@ -198,11 +495,31 @@ func main() {
 		code = http.StatusNotFound
 		return
 	})
+	workerCtx, stopWorkers := context.WithCancel(mainCtx)
+	defer stopWorkers()
+	if cfg.Webhooks.Active {
+		go webhook.Run(workerCtx, cfg, loggerError)
+	}
+	go policy.Run(workerCtx, cfg, loggerError)
+	if cfg.Blocklist.Active {
+		var targets blocklist.Targets
+		if cfg.Rules.Active {
+			// rules' targets are used for redirects only if they are active
+			targets = rules.Targets
+		}
+		go blocklist.Run(workerCtx, cfg, loggerError, targets)
+	}
 	errCh := make(chan error)
 	go interrupt(errCh)
 	go func() {
 		errCh <- server.ListenAndServe()
 	}()
+	if metricsServer != nil {
+		go func() {
+			errCh <- metricsServer.ListenAndServe()
+		}()
+		loggerInfo.Printf("metrics listen: %v\n", metricsServer.Addr)
+	}
 	loggerInfo.Printf("running: version=%v [%v %v]\nListen: %v\n\n",
 		Version, GoVersion, Revision, server.Addr)
 	err = <-errCh
@@ -216,5 +533,10 @@ func main() {
 		if err := server.Shutdown(ctx); err != nil {
 			loggerError.Printf("graceful shutdown error: %v\n", err)
 		}
+		if metricsServer != nil {
+			if err := metricsServer.Shutdown(ctx); err != nil {
+				loggerError.Printf("metrics shutdown error: %v\n", err)
+			}
+		}
 	}
 }
@@ -0,0 +1,303 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package metrics implements service metrics collection
+// and its export in Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// contentType is Prometheus text format content type.
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DefaultBuckets are default histogram buckets of requests durations (seconds).
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// Requests is a counter of handled HTTP requests.
+	Requests = NewCounterVec("lruss_http_requests_total",
+		"Total number of HTTP requests.", "route", "code")
+	// Durations is a histogram of HTTP requests durations.
+	Durations = NewHistogramVec("lruss_http_request_duration_seconds",
+		"HTTP requests latencies in seconds.", DefaultBuckets, "route", "code")
+	// Redirects is a counter of short links redirects.
+	Redirects = NewCounterVec("lruss_redirects_total",
+		"Total number of short links requests.", "result")
+	// Links is a counter of created short links.
+	Links = NewCounterVec("lruss_links_created_total",
+		"Total number of created short links.")
+	// RateRejections is a counter of requests rejected by rate limits.
+	RateRejections = NewCounterVec("lruss_rate_limit_rejections_total",
+		"Total number of requests rejected by rate limits.")
+	// RedisErrors is a counter of failed redis commands.
+	RedisErrors = NewCounterVec("lruss_redis_errors_total",
+		"Total number of failed redis commands.")
+
+	// escaper escapes label values.
+	escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	registry = &metrics{}
+)
+
+// metric is a collected metric.
+type metric interface {
+	write(w io.Writer) error
+}
+
+// metrics is a set of registered metrics.
+type metrics struct {
+	sync.Mutex
+	items []metric
+}
+
+// add appends new metric to the set.
+func (m *metrics) add(item metric) {
+	m.Lock()
+	defer m.Unlock()
+	m.items = append(m.items, item)
+}
+
+// write writes all metrics values.
+func (m *metrics) write(w io.Writer) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, item := range m.items {
+		if err := item.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelsKey returns formatted labels pairs.
+func labelsKey(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("labels mismatch: %v != %v", names, values))
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%v=\"%v\"", name, escaper.Replace(values[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// withLabels returns metric name with labels.
+func withLabels(name string, labels ...string) string {
+	var items []string
+	for _, label := range labels {
+		if label != "" {
+			items = append(items, label)
+		}
+	}
+	if len(items) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%v{%v}", name, strings.Join(items, ","))
+}
+
+// sortedKeys returns sorted keys of the map.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeHeader writes metric's help and type.
+func writeHeader(w io.Writer, name, help, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	return err
+}
+
+// CounterVec is a set of counters with the same labels names.
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers new counter.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		// single counter is exported even it is zero
+		c.values[""] = 0
+	}
+	registry.add(c)
+	return c
+}
+
+// Add increments a counter by v.
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := labelsKey(c.labels, values)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += v
+}
+
+// Inc increments a counter by 1.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// write writes counter values.
+func (c *CounterVec) write(w io.Writer) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := writeHeader(w, c.name, c.help, "counter"); err != nil {
+		return err
+	}
+	keys := make(map[string]bool, len(c.values))
+	for k := range c.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		if _, err := fmt.Fprintf(w, "%v %v\n", withLabels(c.name, k), c.values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogram is values of one histogram.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a set of histograms with the same labels names.
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	values  map[string]*histogram
+}
+
+// NewHistogramVec creates and registers new histogram,
+// buckets are upper bounds, they should be sorted.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		values:  make(map[string]*histogram),
+	}
+	registry.add(h)
+	return h
+}
+
+// Observe adds a new value v to a histogram.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := labelsKey(h.labels, values)
+	h.Lock()
+	defer h.Unlock()
+	item, ok := h.values[key]
+	if !ok {
+		item = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = item
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			item.counts[i]++
+		}
+	}
+	item.sum += v
+	item.count++
+}
+
+// write writes histogram values.
+func (h *HistogramVec) write(w io.Writer) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := writeHeader(w, h.name, h.help, "histogram"); err != nil {
+		return err
+	}
+	keys := make(map[string]bool, len(h.values))
+	for k := range h.values {
+		keys[k] = true
+	}
+	bucket := h.name + "_bucket"
+	for _, k := range sortedKeys(keys) {
+		item := h.values[k]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf("le=\"%v\"", bound)
+			if _, err := fmt.Fprintf(w, "%v %v\n", withLabels(bucket, k, le), item.counts[i]); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%v %v\n%v %v\n%v %v\n",
+			withLabels(bucket, k, "le=\"+Inf\""), item.count,
+			withLabels(h.name+"_sum", k), item.sum,
+			withLabels(h.name+"_count", k), item.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is a gauge which value is got by a function call.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGaugeFunc creates and registers new gauge.
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	registry.add(g)
+	return g
+}
+
+// write writes gauge value.
+func (g *GaugeFunc) write(w io.Writer) error {
+	if err := writeHeader(w, g.name, g.help, "gauge"); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%v %v\n", g.name, g.value())
+	return err
+}
+
+// Handler returns HTTP handler of metrics export.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Handle(r.Context(), w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Handle writes all metrics values.
+func Handle(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	var buffer bytes.Buffer
+	if err := registry.write(&buffer); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := buffer.WriteTo(w); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := &CounterVec{name: "test_total", help: "Test.", labels: []string{"a"}, values: make(map[string]float64)}
+	c.Inc("x")
+	c.Add(2, "x")
+	c.Inc("y\"")
+	var buffer bytes.Buffer
+	if err := c.write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# HELP test_total Test.\n# TYPE test_total counter\n" +
+		"test_total{a=\"x\"} 3\ntest_total{a=\"y\\\"\"} 1\n"
+	if out := buffer.String(); out != expected {
+		t.Errorf("unexpected output:\n%v", out)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &HistogramVec{
+		name:    "test_seconds",
+		help:    "Test.",
+		buckets: []float64{0.1, 1},
+		labels:  []string{"a"},
+		values:  make(map[string]*histogram),
+	}
+	h.Observe(0.05, "x")
+	h.Observe(0.5, "x")
+	h.Observe(5, "x")
+	var buffer bytes.Buffer
+	if err := h.write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# HELP test_seconds Test.\n# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{a=\"x\",le=\"0.1\"} 1\n" +
+		"test_seconds_bucket{a=\"x\",le=\"1\"} 2\n" +
+		"test_seconds_bucket{a=\"x\",le=\"+Inf\"} 3\n" +
+		"test_seconds_sum{a=\"x\"} 5.55\n" +
+		"test_seconds_count{a=\"x\"} 3\n"
+	if out := buffer.String(); out != expected {
+		t.Errorf("unexpected output:\n%v", out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Links.Inc()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status code %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != contentType {
+		t.Errorf("unexpected content type %v", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "lruss_links_created_total 1\n") {
+		t.Errorf("unexpected body:\n%v", body)
+	}
+}
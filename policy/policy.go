@@ -0,0 +1,279 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package policy implements destination URLs policy.
+// URLs are checked by scheme, length, domains allow and deny lists,
+// links to the service itself are rejected to prevent redirect loops.
+// Domains lists are loaded from files, one pattern per line,
+// "*.example.com" matches all subdomains of example.com.
+package policy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/lruss/blocklist"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+var (
+	// mutex protects loaded domains lists.
+	mutex sync.RWMutex
+	// allowed and denied are loaded domains lists.
+	allowed, denied domains
+	// modified are modification times of loaded files.
+	modified = map[string]time.Time{}
+)
+
+// Error is an error of rejected URL.
+type Error struct {
+	Reason string
+}
+
+// Error returns a message of rejected URL.
+func (e *Error) Error() string {
+	return "URL is rejected: " + e.Reason
+}
+
+// reject returns new error of rejected URL.
+func reject(format string, a ...interface{}) error {
+	return &Error{Reason: fmt.Sprintf(format, a...)}
+}
+
+// domains is a list of domains patterns.
+type domains []string
+
+// match checks the host matches the pattern.
+// "*.example.com" matches all subdomains of example.com, other patterns match exactly.
+func match(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return (pattern == "*") || (pattern == host)
+}
+
+// Contains checks the host matches one of patterns.
+func (d domains) Contains(host string) bool {
+	for _, pattern := range d {
+		if match(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize returns domain pattern in the form of normalized punycode hosts.
+func normalize(pattern string) string {
+	value, wildcard := pattern, strings.HasPrefix(pattern, "*.")
+	if wildcard {
+		value = pattern[2:]
+	}
+	if host, err := link.Host(value); err == nil {
+		value = host
+	} else {
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+	}
+	if wildcard {
+		value = "*." + value
+	}
+	return value
+}
+
+// readDomains reads domains patterns from the file, empty lines and comments "#" are skipped.
+func readDomains(name string) (domains, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result domains
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			result = append(result, normalize(line))
+		}
+	}
+	return result, scanner.Err()
+}
+
+// isModified checks the file was changed after last loading.
+func isModified(name string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	mutex.RLock()
+	t, ok := modified[name]
+	mutex.RUnlock()
+	return !ok || !t.Equal(info.ModTime()), nil
+}
+
+// load reads domains list from the file, empty name is an empty list.
+func load(name string) (domains, time.Time, error) {
+	if name == "" {
+		return nil, time.Time{}, nil
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	d, err := readDomains(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return d, info.ModTime(), nil
+}
+
+// Load reads domains allow and deny lists files.
+func Load(cfg *conf.Cfg) error {
+	allow, allowTime, err := load(cfg.Policy.AllowFile)
+	if err != nil {
+		return err
+	}
+	deny, denyTime, err := load(cfg.Policy.DenyFile)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	allowed, denied = allow, deny
+	modified = map[string]time.Time{}
+	if cfg.Policy.AllowFile != "" {
+		modified[cfg.Policy.AllowFile] = allowTime
+	}
+	if cfg.Policy.DenyFile != "" {
+		modified[cfg.Policy.DenyFile] = denyTime
+	}
+	return nil
+}
+
+// Reload reads domains lists files again if one of them is changed.
+// It returns true if the lists are reloaded.
+func Reload(cfg *conf.Cfg) (bool, error) {
+	for _, name := range []string{cfg.Policy.AllowFile, cfg.Policy.DenyFile} {
+		changed, err := isModified(name)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			return true, Load(cfg)
+		}
+	}
+	return false, nil
+}
+
+// Run periodically reloads changed domains lists files until the context is done.
+func Run(ctx context.Context, cfg *conf.Cfg, logger *log.Logger) {
+	period := cfg.Policy.ReloadPeriod()
+	if period == 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := Reload(cfg)
+			if err != nil {
+				// previous lists are used
+				logger.Printf("URL policy reload error: %v", err)
+			} else if reloaded {
+				logger.Println("URL policy domains lists are reloaded")
+			}
+		}
+	}
+}
+
+// Trusted checks the URL host is the service itself or matches trusted domains patterns
+// of interstitial page settings.
+func Trusted(cfg *conf.Cfg, u *url.URL) bool {
+	host, err := link.Host(u.Hostname())
+	if err != nil {
+		return false
+	}
+	site, err := url.Parse(cfg.Site)
+	if (err == nil) && strings.EqualFold(site.Hostname(), host) {
+		return true
+	}
+	for _, pattern := range cfg.Interstitial.Trusted {
+		if match(normalize(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates destination URL and checks its normalized form by the policy.
+// Rejected URLs return *Error.
+func Check(cfg *conf.Cfg, rawURL string) (*url.URL, error) {
+	if n := len(rawURL); n > cfg.Policy.MaxLength {
+		return nil, reject("length %d is greater than maximum %d", n, cfg.Policy.MaxLength)
+	}
+	u, err := link.Validate(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err = link.Normalize(u, cfg.Policy.Strip)
+	if err != nil {
+		return nil, err
+	}
+	scheme := u.Scheme
+	allowedScheme := false
+	for _, s := range cfg.Policy.Schemes {
+		if s == scheme {
+			allowedScheme = true
+			break
+		}
+	}
+	if !allowedScheme {
+		return nil, reject("scheme %q is not allowed", scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		if (u.Opaque == "") || (scheme == "http") || (scheme == "https") {
+			return nil, reject("empty host")
+		}
+		// URL without authority, e.g. "mailto:", domains can't be checked
+		return u, nil
+	}
+	site, err := url.Parse(cfg.Site)
+	if (err == nil) && strings.EqualFold(site.Hostname(), host) {
+		return nil, reject("links to %v are not allowed", site.Hostname())
+	}
+	if cfg.Blocklist.Active {
+		if entry, ok := blocklist.Match(u); ok {
+			return nil, reject("%q is in blocklist", entry)
+		}
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if denied.Contains(host) {
+		return nil, reject("domain %q is denied", host)
+	}
+	if (len(allowed) > 0) && !allowed.Contains(host) {
+		return nil, reject("domain %q is not in allowed list", host)
+	}
+	return u, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/lruss/blocklist"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "lruss_policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestMatch(t *testing.T) {
+	items := []struct {
+		Pattern string
+		Host    string
+		Result  bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"*", "example.com", true},
+	}
+	for i, item := range items {
+		if match(item.Pattern, item.Host) != item.Result {
+			t.Errorf("case %d: unexpected result", i)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Policy.MaxLength = 64
+	cfg.Policy.DenyFile = writeFile(t, "# phishing\nevil.com\n*.evil.org  # all subdomains\n\nпример.рф\n")
+	defer os.Remove(cfg.Policy.DenyFile)
+	if err = Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cfg.Policy.AllowFile, cfg.Policy.DenyFile = "", ""
+		Load(cfg)
+	}()
+	items := map[string]bool{
+		"https://example.com/page":                       true,
+		"ftp://example.com/file":                         true,
+		"https://sub.evil.com/":                          true,
+		"javascript:alert(1)":                            false,
+		"data:text/html;base64,PHNjcmlwdD4=":             false,
+		"file:///etc/passwd":                             false,
+		"http:example.com":                               false,
+		"http:///path":                                   false,
+		"/relative":                                      false,
+		"http://localhost:8070/abc":                      false,
+		"https://EVIL.com./path":                         false,
+		"https://www.evil.org/":                          false,
+		"https://www.evil.org:443/":                      false,
+		"https://XN--E1AFMKFD.xn--p1ai/":                 false,
+		"https://ПРИМЕР.рф/":                             false,
+		"https://example.com/" + strings.Repeat("a", 64): false,
+	}
+	for value, expected := range items {
+		_, err := Check(cfg, value)
+		if (err == nil) != expected {
+			t.Errorf("unexpected result for %v: %v", value, err)
+		}
+	}
+	_, err = Check(cfg, "javascript:alert(1)")
+	if e, ok := err.(*Error); !ok || (e.Reason != `scheme "javascript" is not allowed`) {
+		t.Errorf("unexpected error %v", err)
+	}
+	// allow list
+	cfg.Policy.AllowFile = writeFile(t, "example.com\n*.example.org\n")
+	defer os.Remove(cfg.Policy.AllowFile)
+	reloaded, err := Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Error("allow list is not loaded")
+	}
+	if _, err = Check(cfg, "https://www.example.org/"); err != nil {
+		t.Errorf("allowed URL is rejected: %v", err)
+	}
+	if _, err = Check(cfg, "https://example.net/"); err == nil {
+		t.Error("not allowed URL is accepted")
+	}
+	if reloaded, err = Reload(cfg); err != nil || reloaded {
+		t.Errorf("not changed lists are reloaded: %v", err)
+	}
+	// file modification
+	modTime := time.Now().Add(time.Minute)
+	err = ioutil.WriteFile(cfg.Policy.AllowFile, []byte("example.net\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(cfg.Policy.AllowFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err = Reload(cfg); err != nil || !reloaded {
+		t.Errorf("changed lists are not reloaded: %v", err)
+	}
+	if _, err = Check(cfg, "https://example.net/"); err != nil {
+		t.Errorf("allowed URL is rejected: %v", err)
+	}
+}
+
+func TestCheckBlocklist(t *testing.T) {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Blocklist.Active = true
+	cfg.Blocklist.Files = []string{writeFile(t, "0.0.0.0 phishing.example.com\n")}
+	defer os.Remove(cfg.Blocklist.Files[0])
+	if err = blocklist.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cfg.Blocklist.Files = nil
+		blocklist.Load(cfg)
+	}()
+	_, err = Check(cfg, "https://login.phishing.example.com/")
+	if e, ok := err.(*Error); !ok || (e.Reason != `"phishing.example.com" is in blocklist`) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err = Check(cfg, "https://example.com/"); err != nil {
+		t.Errorf("not blocked URL is rejected: %v", err)
+	}
+	cfg.Blocklist.Active = false
+	if _, err = Check(cfg, "https://phishing.example.com/"); err != nil {
+		t.Errorf("URL is rejected by inactive blocklist: %v", err)
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Interstitial.Trusted = []string{"example.com", "*.example.org", "пример.рф"}
+	items := map[string]bool{
+		"https://example.com/":           true,
+		"https://www.example.com/":       false,
+		"https://docs.EXAMPLE.org/":      true,
+		"https://example.org/":           false,
+		"https://xn--e1afmkfd.xn--p1ai/": true,
+		cfg.Site + "/abc":                true,
+		"https://example.net/":           false,
+	}
+	for value, expected := range items {
+		u, err := url.Parse(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Trusted(cfg, u) != expected {
+			t.Errorf("unexpected result for %v", value)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package privacy implements methods to anonymize clients' data.
+// IP addresses are truncated to a network prefix and can be hashed
+// with a salt that is rotated periodically.
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	// saltLen is length of salt random value (bytes).
+	saltLen = 32
+	// idLen is length of hashed identifier (bytes).
+	idLen = 12
+)
+
+var (
+	// purgePrefixes are db prefixes of records with clients' identifiers.
+	purgePrefixes = []string{"host", "reporter", "fail", "lock"}
+)
+
+// parseHost returns IP address from a host value with optional port,
+// IPv6 address can be in square brackets. It returns nil for invalid values.
+func parseHost(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	return net.ParseIP(strings.Trim(value, "[]"))
+}
+
+// forwardedFor returns "for" parameters values of Forwarded header (RFC 7239).
+func forwardedFor(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if (len(pair) > 4) && strings.EqualFold(pair[:4], "for=") {
+					result = append(result, pair[4:])
+				}
+			}
+		}
+	}
+	return result
+}
+
+// forwardedChain returns IP addresses of proxies chain from request's headers,
+// the nearest one is the last. Forwarded header has a priority over X-Forwarded-For and X-Real-IP.
+func forwardedChain(r *http.Request) []string {
+	if values := forwardedFor(r.Header["Forwarded"]); len(values) > 0 {
+		return values
+	}
+	if values := r.Header["X-Forwarded-For"]; len(values) > 0 {
+		return strings.Split(strings.Join(values, ","), ",")
+	}
+	if value := r.Header.Get("X-Real-Ip"); value != "" {
+		return []string{value}
+	}
+	return nil
+}
+
+// ClientIP returns request's client IP address. Proxy headers are used only
+// if the request is received from a trusted proxy, the chain is checked
+// from the nearest proxy and the first not trusted address is the client.
+// It returns nil if the address is unknown.
+func ClientIP(cfg *conf.Cfg, r *http.Request) net.IP {
+	ip := parseHost(r.RemoteAddr)
+	if (ip == nil) || !cfg.Proxies.IsTrusted(ip) {
+		return ip
+	}
+	chain := forwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		next := parseHost(chain[i])
+		if next == nil {
+			// unknown or obfuscated address, the previous one is the last known
+			break
+		}
+		ip = next
+		if !cfg.Proxies.IsTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// RemoteIP returns request's client IP address, it's masked if privacy settings are active.
+func RemoteIP(cfg *conf.Cfg, r *http.Request) string {
+	ip := ClientIP(cfg, r)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	return Mask(ip, cfg).String()
+}
+
+// Mask truncates IP address to the configured network prefix.
+func Mask(ip net.IP, cfg *conf.Cfg) net.IP {
+	if !cfg.Privacy.Active {
+		return ip
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(cfg.Privacy.IPv4Mask, 32))
+	}
+	return ip.Mask(net.CIDRMask(cfg.Privacy.IPv6Mask, 128))
+}
+
+// period returns a number of current salt rotation period.
+func period(cfg *conf.Cfg) int64 {
+	return time.Now().Unix() / int64(cfg.Privacy.SaltTTL)
+}
+
+// salt returns a salt of the rotation period n.
+// New salt is created only if create is true, otherwise empty value is returned.
+func salt(c redis.Conn, cfg *conf.Cfg, n int64, create bool) (string, error) {
+	saltKey, err := conf.DbKey("salt", fmt.Sprint(n))
+	if err != nil {
+		return "", err
+	}
+	value, err := redis.String(c.Do("GET", saltKey))
+	if err != redis.ErrNil {
+		return value, err
+	}
+	if !create {
+		return "", nil
+	}
+	b := make([]byte, saltLen)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	value = hex.EncodeToString(b)
+	// keep it during next period to find data of previous one
+	_, err = redis.String(c.Do("SET", saltKey, value, "EX", 2*cfg.Privacy.SaltTTL, "NX"))
+	if err == redis.ErrNil {
+		// other goroutine did it before
+		return redis.String(c.Do("GET", saltKey))
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// hash returns a keyed hash of value.
+func hash(salt, value string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:idLen])
+}
+
+// isHashed returns true if client identifiers are hashed.
+func isHashed(cfg *conf.Cfg) bool {
+	return cfg.Privacy.Active && cfg.Privacy.Hash
+}
+
+// identify returns a client identifier using salt value.
+func identify(cfg *conf.Cfg, salt string, ip net.IP, userAgent string) string {
+	host := Mask(ip, cfg).String()
+	if isHashed(cfg) {
+		host = hash(salt, host)
+		if userAgent != "" {
+			userAgent = hash(salt, userAgent)
+		}
+	}
+	if userAgent == "" {
+		return host
+	}
+	return fmt.Sprintf("%v:ua:%v", host, userAgent)
+}
+
+// ClientID returns an identifier of the client by its IP address and user agent.
+// The user agent is not used if it is empty.
+func ClientID(c redis.Conn, cfg *conf.Cfg, host, userAgent string) (string, error) {
+	var s string
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", host)
+	}
+	if isHashed(cfg) {
+		value, err := salt(c, cfg, period(cfg), true)
+		if err != nil {
+			return "", err
+		}
+		s = value
+	}
+	return identify(cfg, s, ip, userAgent), nil
+}
+
+// Purge removes all stored data of the client with IP address host,
+// including rate limits records of its aggregated network.
+// It returns a number of deleted db records.
+func Purge(c redis.Conn, cfg *conf.Cfg, host string) (int, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IP address %q", host)
+	}
+	addresses := []net.IP{ip}
+	if network := cfg.Rate.Aggregate(ip); !network.Equal(ip) {
+		addresses = append(addresses, network)
+	}
+	salts := []string{""}
+	if isHashed(cfg) {
+		salts = salts[:0]
+		n := period(cfg)
+		// data can be saved during current and previous periods
+		for _, p := range []int64{n, n - 1} {
+			s, err := salt(c, cfg, p, false)
+			if err != nil {
+				return 0, err
+			}
+			if s != "" {
+				salts = append(salts, s)
+			}
+		}
+	}
+	var ids []string
+	for _, address := range addresses {
+		for _, s := range salts {
+			ids = append(ids, identify(cfg, s, address, ""))
+		}
+	}
+	deleted := 0
+	for _, prefix := range purgePrefixes {
+		for _, id := range ids {
+			for _, pattern := range []string{id, id + ":*"} {
+				dbKey, err := conf.DbKey(prefix, pattern)
+				if err != nil {
+					return 0, err
+				}
+				keys, err := redis.Strings(c.Do("KEYS", dbKey))
+				if err != nil {
+					return 0, err
+				}
+				for _, key := range keys {
+					n, err := redis.Int(c.Do("DEL", key))
+					if err != nil {
+						return 0, err
+					}
+					deleted += n
+				}
+			}
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	cfg.Privacy.Active = true
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestMask(t *testing.T) {
+	cfg := &conf.Cfg{}
+	cfg.Privacy.IPv4Mask, cfg.Privacy.IPv6Mask = 24, 48
+	items := []struct {
+		Active bool
+		In     string
+		Out    string
+	}{
+		{false, "192.168.1.100", "192.168.1.100"},
+		{true, "192.168.1.100", "192.168.1.0"},
+		{true, "::ffff:10.1.2.3", "10.1.2.0"},
+		{true, "2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+	}
+	for _, item := range items {
+		cfg.Privacy.Active = item.Active
+		if out := Mask(net.ParseIP(item.In), cfg).String(); out != item.Out {
+			t.Errorf("result mismatch for '%s', get %v, expected %v", item.In, out, item.Out)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trusted proxies: 127.0.0.1, ::1
+	items := []struct {
+		Remote string
+		Header map[string]string
+		Out    string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.5"}, "192.0.2.1"},
+		{"127.0.0.1:1234", nil, "127.0.0.1"},
+		{"127.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.5"}, "203.0.113.5"},
+		{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.5"}, "203.0.113.5"},
+		{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.5, 127.0.0.1"}, "203.0.113.5"},
+		{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "unknown, 127.0.0.1"}, "127.0.0.1"},
+		{"[::1]:1234", map[string]string{"X-Forwarded-For": "2001:db8::1"}, "2001:db8::1"},
+		{"127.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.43, for="[2001:db8:cafe::17]:4711";proto=https`}, "2001:db8:cafe::17"},
+		{"127.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden;by=127.0.0.1"}, "127.0.0.1"},
+		{"127.0.0.1:1234", map[string]string{"Forwarded": "For=192.0.2.43", "X-Forwarded-For": "203.0.113.5"}, "192.0.2.43"},
+	}
+	for i, item := range items {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = item.Remote
+		for name, value := range item.Header {
+			r.Header.Set(name, value)
+		}
+		if ip := ClientIP(cfg, r); ip.String() != item.Out {
+			t.Errorf("case %d: unexpected client IP %v", i, ip)
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "bad"
+	if ip := ClientIP(cfg, r); ip != nil {
+		t.Errorf("unexpected client IP %v", ip)
+	}
+	if ip := RemoteIP(cfg, r); ip != "bad" {
+		t.Errorf("unexpected remote IP %v", ip)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	if _, err := ClientID(c, cfg, "bad", ""); err == nil {
+		t.Error("unexpected behavior")
+	}
+	cfg.Privacy.Hash = false
+	id, err := ClientID(c, cfg, "192.168.1.100", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "192.168.1.0:ua:test" {
+		t.Errorf("unexpected id %v", id)
+	}
+	cfg.Privacy.Hash = true
+	id, err = ClientID(c, cfg, "192.168.1.100", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(id); l != idLen*2 {
+		t.Errorf("invalid id length %d", l)
+	}
+	other, err := ClientID(c, cfg, "192.168.1.200", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other != id {
+		t.Errorf("ids of one network mismatch: %v != %v", id, other)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	hosts := []string{"10.0.0.1", "10.0.1.1"}
+	for _, host := range hosts {
+		for _, ua := range []string{"", "test"} {
+			id, err := ClientID(c, cfg, host, ua)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hostKey, err := conf.DbKey("host", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reporterKey, err := conf.DbKey("reporter", id+":abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			failKey, err := conf.DbKey("fail", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lockKey, err := conf.DbKey("lock", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.Do("MSET", hostKey, 1, reporterKey, 1, failKey, 1, lockKey, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n, err := Purge(c, cfg, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 8 {
+		t.Errorf("unexpected number of deleted records %d", n)
+	}
+	for _, pattern := range []string{"host:*", "reporter:*", "fail:*", "lock:*"} {
+		keys, err := redis.Strings(c.Do("KEYS", pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 {
+			t.Errorf("unexpected keys %v", keys)
+		}
+	}
+}
+
+func TestPurgeNetwork(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	cfg.Privacy.Active = false
+	cfg.Rate.IPv4Prefix, cfg.Rate.IPv6Prefix = 24, 64
+	// rate limits records use aggregated networks of clients
+	for _, host := range []string{"192.0.2.1", "198.51.100.1", "2001:db8::1", "2001:db8:0:1::1"} {
+		id, err := ClientID(c, cfg, cfg.Rate.Aggregate(net.ParseIP(host)).String(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostKey, err := conf.DbKey("host", id+":api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Do("SET", hostKey, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, host := range []string{"192.0.2.7", "2001:db8::2"} {
+		if n, err := Purge(c, cfg, host); (err != nil) || (n != 1) {
+			t.Errorf("unexpected result for %v: %v, %v", host, n, err)
+		}
+	}
+	keys, err := redis.Strings(c.Do("KEYS", "host:*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if (len(keys) != 2) || (keys[0] != "host:198.51.100.0:api") || (keys[1] != "host:2001:db8:0:1:::api") {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
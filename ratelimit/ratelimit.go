@@ -0,0 +1,368 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package ratelimit implements requests rate limiting algorithms.
+// Every algorithm is an atomic Lua script, so concurrent requests
+// can't exceed the limit and a counter can't persist without a lifetime.
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/privacy"
+)
+
+const (
+	// Fixed is a name of fixed window counter algorithm.
+	Fixed = "fixed"
+	// Sliding is a name of sliding window log algorithm.
+	Sliding = "sliding"
+	// Token is a name of token bucket algorithm.
+	Token = "token"
+
+	// API is a route name of anonymous links creation.
+	API = "api"
+)
+
+var (
+	// now returns current time, it can be replaced in tests.
+	now = time.Now
+
+	// fixedScript counts requests during a window.
+	// KEYS[1] - counter, ARGV[1] - window (ms), ARGV[2] - cost (0 doesn't register a request).
+	// It returns a number of requests and remaining time of the window (ms).
+	fixedScript = redis.NewScript(1, `
+local cost = tonumber(ARGV[2])
+local n = tonumber(redis.call('GET', KEYS[1]) or '0')
+if cost > 0 then
+	n = redis.call('INCRBY', KEYS[1], cost)
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if (ttl < 0) and (n > 0) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {n, math.max(ttl, 0)}
+`)
+
+	// slidingScript saves timestamps of allowed requests during last window.
+	// KEYS[1] - sorted set, ARGV[1] - limit, ARGV[2] - window (ms), ARGV[3] - now (ms),
+	// ARGV[4] - unique member, ARGV[5] - cost (0 doesn't register a request).
+	// It returns 1 if the request is allowed, a number of requests in the window
+	// and time (ms) until the oldest one leaves the window.
+	slidingScript = redis.NewScript(1, `
+local limit, window, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local cost = tonumber(ARGV[5])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if n < limit then
+	if cost > 0 then
+		redis.call('ZADD', KEYS[1], now, ARGV[4])
+		redis.call('PEXPIRE', KEYS[1], window)
+		n = n + 1
+	end
+	allowed = 1
+end
+local reset = 0
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, n, reset}
+`)
+
+	// tokenScript takes a token from a bucket which is refilled by count tokens every interval.
+	// KEYS[1] - hash, ARGV[1] - capacity, ARGV[2] - count, ARGV[3] - interval (ms), ARGV[4] - now (ms),
+	// ARGV[5] - cost (0 doesn't take a token).
+	// It returns 1 if the request is allowed, a number of remaining tokens,
+	// time (ms) until next token and time (ms) until the bucket is full.
+	tokenScript = redis.NewScript(1, `
+local capacity, count = tonumber(ARGV[1]), tonumber(ARGV[2])
+local interval, now = tonumber(ARGV[3]), tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens, ts = tonumber(state[1]), tonumber(state[2])
+if (tokens == nil) or (ts == nil) then
+	tokens, ts = capacity, now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * count / interval)
+	ts = now
+end
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - cost
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * interval / count)
+end
+local full = math.ceil((capacity - tokens) * interval / count)
+if cost > 0 then
+	redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+	redis.call('PEXPIRE', KEYS[1], math.max(full, 1))
+end
+return {allowed, math.floor(tokens), wait, full}
+`)
+)
+
+// Result is a rate limit check result.
+type Result struct {
+	Allowed bool
+	// Limit is maximum number of requests.
+	Limit int64
+	// Remaining is a number of requests which are allowed now.
+	Remaining int64
+	// Reset is time until the limit is fully restored.
+	Reset time.Duration
+	// RetryAfter is time until next allowed request if current one is rejected.
+	RetryAfter time.Duration
+}
+
+// Limiter is a rate limiting algorithm.
+type Limiter interface {
+	// Allow registers a request of the client identified by db key and checks its limit.
+	Allow(c redis.Conn, key string) (*Result, error)
+	// Peek returns current limit state of the client without request registration,
+	// Allowed is a result of next request.
+	Peek(c redis.Conn, key string) (*Result, error)
+}
+
+// FixedWindow allows Limit requests during every Window,
+// the window starts from the first request.
+type FixedWindow struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// Allow checks fixed window limit.
+func (l *FixedWindow) Allow(c redis.Conn, key string) (*Result, error) {
+	return l.check(c, key, 1)
+}
+
+// Peek returns fixed window limit state.
+func (l *FixedWindow) Peek(c redis.Conn, key string) (*Result, error) {
+	return l.check(c, key, 0)
+}
+
+// check registers cost requests and checks fixed window limit.
+func (l *FixedWindow) check(c redis.Conn, key string, cost int64) (*Result, error) {
+	values, err := redis.Int64s(fixedScript.Do(c, key, milliseconds(l.Window), cost))
+	if err != nil {
+		return nil, err
+	}
+	n, ttl := values[0], time.Duration(values[1])*time.Millisecond
+	result := &Result{Limit: l.Limit, Reset: ttl}
+	if n < l.Limit {
+		result.Remaining = l.Limit - n
+	}
+	if cost > 0 {
+		result.Allowed = n <= l.Limit
+	} else {
+		result.Allowed = result.Remaining > 0
+	}
+	if !result.Allowed {
+		result.RetryAfter = ttl
+	}
+	return result, nil
+}
+
+// SlidingLog allows Limit requests during any Window,
+// timestamps of allowed requests are saved.
+type SlidingLog struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// Allow checks sliding window limit.
+func (l *SlidingLog) Allow(c redis.Conn, key string) (*Result, error) {
+	return l.check(c, key, 1)
+}
+
+// Peek returns sliding window limit state.
+func (l *SlidingLog) Peek(c redis.Conn, key string) (*Result, error) {
+	return l.check(c, key, 0)
+}
+
+// check registers a request if cost isn't zero and checks sliding window limit.
+func (l *SlidingLog) check(c redis.Conn, key string, cost int64) (*Result, error) {
+	ts := milliseconds(now().Sub(time.Unix(0, 0)))
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	member := fmt.Sprintf("%d-%v", ts, hex.EncodeToString(b))
+	values, err := redis.Int64s(slidingScript.Do(c, key, l.Limit, milliseconds(l.Window), ts, member, cost))
+	if err != nil {
+		return nil, err
+	}
+	reset := time.Duration(values[2]) * time.Millisecond
+	result := &Result{Allowed: values[0] == 1, Limit: l.Limit, Remaining: l.Limit - values[1], Reset: reset}
+	if !result.Allowed {
+		result.RetryAfter = reset
+	}
+	return result, nil
+}
+
+// TokenBucket allows Burst requests at once, the bucket
+// is refilled by Rate tokens during every Interval.
+type TokenBucket struct {
+	Rate     int64
+	Interval time.Duration
+	Burst    int64
+}
+
+// Allow checks token bucket limit.
+func (l *TokenBucket) Allow(c redis.Conn, key string) (*Result, error) {
+	return l.check(c, key, 1)
+}
+
+// Peek returns token bucket limit state.
+func (l *TokenBucket) Peek(c redis.Conn, key string) (*Result, error) {
+	return l.check(c, key, 0)
+}
+
+// check takes cost tokens and checks token bucket limit.
+func (l *TokenBucket) check(c redis.Conn, key string, cost int64) (*Result, error) {
+	ts := milliseconds(now().Sub(time.Unix(0, 0)))
+	values, err := redis.Int64s(tokenScript.Do(c, key, l.Burst, l.Rate, milliseconds(l.Interval), ts, cost))
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Allowed:    values[0] == 1,
+		Limit:      l.Burst,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		Reset:      time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+// milliseconds returns duration in milliseconds, but not less than one.
+func milliseconds(d time.Duration) int64 {
+	if ms := int64(d / time.Millisecond); ms > 0 {
+		return ms
+	}
+	return 1
+}
+
+// New returns a limiter by algorithm name, count requests are allowed during interval.
+// Burst is a capacity of token bucket, count is used if it's not set.
+func New(algorithm string, count int64, interval time.Duration, burst int64) (Limiter, error) {
+	if (count < 1) || (interval <= 0) {
+		return nil, fmt.Errorf("invalid rate limit %d/%v", count, interval)
+	}
+	switch algorithm {
+	case Fixed, "":
+		return &FixedWindow{Limit: count, Window: interval}, nil
+	case Sliding:
+		return &SlidingLog{Limit: count, Window: interval}, nil
+	case Token:
+		if burst < 1 {
+			burst = count
+		}
+		return &TokenBucket{Rate: count, Interval: interval, Burst: burst}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+}
+
+// Client returns an identifier of request's client, it depends on privacy settings
+// and rate limit network prefixes.
+func Client(c redis.Conn, cfg *conf.Cfg, r *http.Request) (string, error) {
+	var userAgent string
+	ip := privacy.ClientIP(cfg, r)
+	if ip == nil {
+		return "", fmt.Errorf("unknown client address %q", r.RemoteAddr)
+	}
+	if cfg.Rate.CheckUserAgent {
+		userAgent = r.UserAgent()
+	}
+	// clients of the same network share limits
+	return privacy.ClientID(c, cfg, cfg.Rate.Aggregate(ip).String(), userAgent)
+}
+
+// limiter returns a limiter of the route and db key of request's client.
+// The limiter is nil if rate limits are disabled or the route isn't limited.
+func limiter(c redis.Conn, cfg *conf.Cfg, route string, r *http.Request) (Limiter, string, error) {
+	if !cfg.Rate.Active {
+		return nil, "", nil
+	}
+	settings, ok := cfg.Rate.Limit(route)
+	if !ok {
+		return nil, "", nil
+	}
+	// client's data lifetime is limited by privacy settings
+	interval := time.Duration(cfg.ClientDataTTL(settings.Interval)) * time.Second
+	l, err := New(settings.Algorithm, settings.Count, interval, settings.Burst)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := Client(c, cfg, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if route != API {
+		// separate limits of the client for every route
+		client += ":" + route
+	}
+	hostKey, err := conf.DbKey("host", client)
+	if err != nil {
+		return nil, "", err
+	}
+	return l, hostKey, nil
+}
+
+// Check registers a request of the route and checks its rate limit.
+// It returns nil if rate limits are disabled or the route isn't limited.
+func Check(c redis.Conn, cfg *conf.Cfg, route string, r *http.Request) (*Result, error) {
+	l, hostKey, err := limiter(c, cfg, route, r)
+	if (l == nil) || (err != nil) {
+		return nil, err
+	}
+	return l.Allow(c, hostKey)
+}
+
+// Status returns current rate limit state of the route for request's client.
+// It returns nil if rate limits are disabled or the route isn't limited.
+func Status(c redis.Conn, cfg *conf.Cfg, route string, r *http.Request) (*Result, error) {
+	l, hostKey, err := limiter(c, cfg, route, r)
+	if (l == nil) || (err != nil) {
+		return nil, err
+	}
+	return l.Peek(c, hostKey)
+}
+
+// seconds returns duration in seconds rounded up.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// SetHeaders sets rate limit response headers, both common X-RateLimit-*
+// and IETF draft RateLimit-* ones. Retry-After is set for rejected requests.
+// X-RateLimit-Reset is Unix time, RateLimit-Reset is a number of seconds.
+func SetHeaders(w http.ResponseWriter, result *Result) {
+	reset := seconds(result.Reset)
+	limit, remaining := fmt.Sprint(result.Limit), fmt.Sprint(result.Remaining)
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", limit)
+	h.Set("X-RateLimit-Remaining", remaining)
+	h.Set("X-RateLimit-Reset", fmt.Sprint(now().Add(time.Duration(reset)*time.Second).Unix()))
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", fmt.Sprint(reset))
+	if !result.Allowed {
+		retry := seconds(result.RetryAfter)
+		if retry < 1 {
+			retry = 1
+		}
+		h.Set("Retry-After", fmt.Sprint(retry))
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		count     int64
+		interval  time.Duration
+		ok        bool
+	}{
+		{"", 10, time.Second, true},
+		{Fixed, 10, time.Second, true},
+		{Sliding, 10, time.Second, true},
+		{Token, 10, time.Second, true},
+		{"unknown", 10, time.Second, false},
+		{Fixed, 0, time.Second, false},
+		{Fixed, 10, 0, false},
+	}
+	for i, v := range cases {
+		_, err := New(v.algorithm, v.count, v.interval, 0)
+		if (err == nil) != v.ok {
+			t.Errorf("case %d: unexpected result %v", i, err)
+		}
+	}
+	l, err := New(Token, 10, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := l.(*TokenBucket); b.Burst != 10 {
+		t.Errorf("invalid default burst %v", b.Burst)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	l := &FixedWindow{Limit: 2, Window: time.Minute}
+	for i, expected := range []bool{true, true, false, false} {
+		result, err := l.Allow(c, "test_fixed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != expected {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+		if expected && (result.Remaining != int64(1-i)) {
+			t.Errorf("invalid remaining %d: %+v", i, result)
+		}
+		if !expected && ((result.RetryAfter <= 0) || (result.RetryAfter > time.Minute)) {
+			t.Errorf("invalid retry %d: %+v", i, result)
+		}
+	}
+	ttl, err := redis.Int64(c.Do("PTTL", "test_fixed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (ttl <= 0) || (ttl > 60000) {
+		t.Errorf("invalid counter lifetime %v", ttl)
+	}
+	// counter without lifetime gets it
+	_, err = c.Do("SET", "test_fixed", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Allow(c, "test_fixed"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err = redis.Int64(c.Do("PTTL", "test_fixed")); (err != nil) || (ttl <= 0) {
+		t.Errorf("counter lifetime is not set %v: %v", ttl, err)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	ts := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { now = time.Now }()
+	l := &SlidingLog{Limit: 2, Window: time.Minute}
+	cases := []struct {
+		offset  time.Duration
+		allowed bool
+	}{
+		{0, true},
+		{30 * time.Second, true},
+		{45 * time.Second, false},
+		{61 * time.Second, true},  // first one left the window
+		{75 * time.Second, false}, // second one is in the window
+		{91 * time.Second, true},
+	}
+	for i, v := range cases {
+		now = func() time.Time { return ts.Add(v.offset) }
+		result, err := l.Allow(c, "test_sliding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != v.allowed {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+		if i == 2 && (result.RetryAfter != 15*time.Second) {
+			t.Errorf("invalid retry %d: %+v", i, result)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	ts := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { now = time.Now }()
+	// 1 token per second, 3 tokens at once
+	l := &TokenBucket{Rate: 1, Interval: time.Second, Burst: 3}
+	cases := []struct {
+		offset    time.Duration
+		allowed   bool
+		remaining int64
+	}{
+		{0, true, 2},
+		{0, true, 1},
+		{0, true, 0},
+		{500 * time.Millisecond, false, 0},
+		{time.Second, true, 0},
+		{10 * time.Second, true, 2},
+	}
+	for i, v := range cases {
+		now = func() time.Time { return ts.Add(v.offset) }
+		result, err := l.Allow(c, "test_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (result.Allowed != v.allowed) || (result.Remaining != v.remaining) || (result.Limit != 3) {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+		if i == 3 && (result.RetryAfter != 500*time.Millisecond) {
+			t.Errorf("invalid retry %d: %+v", i, result)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	r := httptest.NewRequest("GET", "/abc", nil)
+	result, err := Check(c, cfg, "unknown", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+	cfg.Rate.Count = 1
+	for i, expected := range []bool{true, false} {
+		result, err = Check(c, cfg, API, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != expected {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+	}
+	result, err = Status(c, cfg, API, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || (result.Limit != 1) {
+		t.Errorf("unexpected status %+v", result)
+	}
+	// other route has own limit
+	result, err = Check(c, cfg, "redirect", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Errorf("unexpected result %+v", result)
+	}
+	cfg.Rate.Active = false
+	if result, err = Check(c, cfg, API, r); (err != nil) || (result != nil) {
+		t.Errorf("unexpected result %+v: %v", result, err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+
+	limiters := map[string]Limiter{
+		"test_peek_fixed":   &FixedWindow{Limit: 1, Window: time.Minute},
+		"test_peek_sliding": &SlidingLog{Limit: 1, Window: time.Minute},
+		"test_peek_token":   &TokenBucket{Rate: 1, Interval: time.Minute, Burst: 1},
+	}
+	for key, l := range limiters {
+		result, err := l.Peek(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || (result.Remaining != 1) {
+			t.Errorf("%v: unexpected initial state %+v", key, result)
+		}
+		n, err := redis.Int(c.Do("EXISTS", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%v: request is registered", key)
+		}
+		if result, err = l.Allow(c, key); (err != nil) || !result.Allowed {
+			t.Fatalf("%v: unexpected result %+v: %v", key, result, err)
+		}
+		for i := 0; i < 2; i++ {
+			// state isn't changed
+			result, err = l.Peek(c, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed || (result.Remaining != 0) || (result.RetryAfter <= 0) {
+				t.Errorf("%v: unexpected state %+v", key, result)
+			}
+		}
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	ts := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+
+	w := httptest.NewRecorder()
+	SetHeaders(w, &Result{Allowed: true, Limit: 10, Remaining: 9, Reset: 1500 * time.Millisecond})
+	expected := map[string]string{
+		"X-RateLimit-Limit":     "10",
+		"X-RateLimit-Remaining": "9",
+		"X-RateLimit-Reset":     fmt.Sprint(ts.Unix() + 2),
+		"RateLimit-Limit":       "10",
+		"RateLimit-Remaining":   "9",
+		"RateLimit-Reset":       "2",
+		"Retry-After":           "",
+	}
+	for name, value := range expected {
+		if v := w.Header().Get(name); v != value {
+			t.Errorf("invalid header %v: %q", name, v)
+		}
+	}
+	w = httptest.NewRecorder()
+	SetHeaders(w, &Result{Limit: 10, Reset: time.Minute, RetryAfter: 100 * time.Millisecond})
+	if v := w.Header().Get("Retry-After"); v != "1" {
+		t.Errorf("invalid Retry-After header %q", v)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/z0rr0/lruss/conf"
+)
+
+var (
+	// mutex protects loaded GeoIP networks.
+	mutex sync.RWMutex
+	// networks are loaded GeoIP networks sorted by first address.
+	networks []network
+)
+
+// network is an addresses range of a country.
+type network struct {
+	first   net.IP
+	last    net.IP
+	country string
+}
+
+// parseNetwork returns a network of GeoIP line "network,country",
+// other columns are ignored.
+func parseNetwork(line string) (network, bool) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 2 {
+		return network{}, false
+	}
+	_, n, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return network{}, false
+	}
+	country := strings.ToUpper(strings.Trim(strings.TrimSpace(fields[1]), `"`))
+	if len(country) != 2 {
+		return network{}, false
+	}
+	last := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		last[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return network{first: n.IP.To16(), last: last.To16(), country: country}, true
+}
+
+// readNetworks reads GeoIP file, invalid lines (e.g. a header) and comments "#" are skipped.
+func readNetworks(name string) ([]network, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []network
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if n, ok := parseNetwork(line); ok {
+			result = append(result, n)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].first, result[j].first) < 0
+	})
+	return result, nil
+}
+
+// Load reads GeoIP file, empty file name clears loaded networks.
+func Load(cfg *conf.Cfg) error {
+	var (
+		items []network
+		err   error
+	)
+	if cfg.Rules.GeoIP != "" {
+		items, err = readNetworks(cfg.Rules.GeoIP)
+		if err != nil {
+			return err
+		}
+	}
+	mutex.Lock()
+	networks = items
+	mutex.Unlock()
+	return nil
+}
+
+// Size returns a number of loaded GeoIP networks.
+func Size() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(networks)
+}
+
+// Country returns a country code of the IP address or empty string if it's unknown.
+// Networks are expected not to overlap.
+func Country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	i := sort.Search(len(networks), func(i int) bool {
+		return bytes.Compare(networks[i].first, ip) > 0
+	}) - 1
+	if (i >= 0) && (bytes.Compare(ip, networks[i].last) <= 0) {
+		return networks[i].country
+	}
+	return ""
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package rules implements conditional redirects of short links.
+// A link has an ordered list of rules saved in "rules:<short>" key,
+// the first rule matching client's device, preferred language, country and current time
+// sets the redirect target, the link's URL is used if no rule is matched.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/policy"
+	"github.com/z0rr0/lruss/privacy"
+)
+
+// Devices classes of user agents.
+const (
+	IOS     = "ios"
+	Android = "android"
+	Other   = "other"
+)
+
+var (
+	// Devices are known devices classes.
+	Devices = []string{IOS, Android, Other}
+	// now returns current time, it can be replaced in tests.
+	now = time.Now
+)
+
+// Rule is a conditional redirect target, empty conditions match any client.
+// Time is a daily window "HH:MM-HH:MM" in UTC, it can be over midnight.
+type Rule struct {
+	Device    string   `json:"device,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+	Countries []string `json:"countries,omitempty"`
+	Time      string   `json:"time,omitempty"`
+	Target    string   `json:"target"`
+}
+
+// client is request's properties checked by rules.
+type client struct {
+	device   string
+	language string
+	country  string
+	minute   int
+}
+
+// contains checks the value is in the list.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock returns minutes of the day of "HH:MM" value.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// window returns bounds of daily time window in minutes.
+func window(value string) (int, int, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid time window %q", value)
+	}
+	from, err := parseClock(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseClock(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		return 0, 0, fmt.Errorf("empty time window %q", value)
+	}
+	return from, to, nil
+}
+
+// isValid checks and normalizes rule's conditions and target URL.
+func (r *Rule) isValid(cfg *conf.Cfg) error {
+	r.Device = strings.ToLower(r.Device)
+	if (r.Device != "") && !contains(Devices, r.Device) {
+		return fmt.Errorf("unknown device %q", r.Device)
+	}
+	for i, language := range r.Languages {
+		r.Languages[i] = strings.ToLower(strings.TrimSpace(language))
+		if (r.Languages[i] == "") || (len(r.Languages[i]) > 35) {
+			return fmt.Errorf("invalid language %q", language)
+		}
+	}
+	for i, country := range r.Countries {
+		r.Countries[i] = strings.ToUpper(strings.TrimSpace(country))
+		if len(r.Countries[i]) != 2 {
+			return fmt.Errorf("invalid country %q", country)
+		}
+	}
+	if r.Time != "" {
+		if _, _, err := window(r.Time); err != nil {
+			return err
+		}
+	}
+	u, err := policy.Check(cfg, r.Target)
+	if err != nil {
+		return err
+	}
+	r.Target = u.String()
+	return nil
+}
+
+// match checks the client satisfies all rule's conditions.
+func (r *Rule) match(cl *client) bool {
+	if (r.Device != "") && (r.Device != cl.device) {
+		return false
+	}
+	if len(r.Languages) > 0 {
+		found := false
+		for _, language := range r.Languages {
+			if (cl.language == language) || strings.HasPrefix(cl.language, language+"-") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if (len(r.Countries) > 0) && !contains(r.Countries, cl.country) {
+		return false
+	}
+	if r.Time != "" {
+		from, to, err := window(r.Time)
+		if err != nil {
+			return false
+		}
+		if from < to {
+			return (from <= cl.minute) && (cl.minute < to)
+		}
+		return (cl.minute >= from) || (cl.minute < to)
+	}
+	return true
+}
+
+// String returns the rule in text form "device=ios lang=en,de country=US time=09:00-18:00 <target>".
+func (r *Rule) String() string {
+	var fields []string
+	if r.Device != "" {
+		fields = append(fields, "device="+r.Device)
+	}
+	if len(r.Languages) > 0 {
+		fields = append(fields, "lang="+strings.Join(r.Languages, ","))
+	}
+	if len(r.Countries) > 0 {
+		fields = append(fields, "country="+strings.Join(r.Countries, ","))
+	}
+	if r.Time != "" {
+		fields = append(fields, "time="+r.Time)
+	}
+	return strings.Join(append(fields, r.Target), " ")
+}
+
+// Parse reads rules in text form, one rule per line: conditions "name=value"
+// and a target URL in the end. Empty lines and comments are skipped,
+// a comment starts with "#" in the beginning of the line or after whitespace,
+// so targets' fragments are kept.
+func Parse(text string) ([]Rule, error) {
+	var result []Rule
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		for j, field := range fields {
+			if strings.HasPrefix(field, "#") {
+				fields = fields[:j]
+				break
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		r := Rule{Target: fields[len(fields)-1]}
+		for _, field := range fields[:len(fields)-1] {
+			parts := strings.SplitN(field, "=", 2)
+			if (len(parts) != 2) || (parts[1] == "") {
+				return nil, fmt.Errorf("line %d: invalid condition %q", i+1, field)
+			}
+			switch parts[0] {
+			case "device":
+				r.Device = parts[1]
+			case "lang":
+				r.Languages = strings.Split(parts[1], ",")
+			case "country":
+				r.Countries = strings.Split(parts[1], ",")
+			case "time":
+				r.Time = parts[1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown condition %q", i+1, parts[0])
+			}
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// Format returns rules in text form, one rule per line.
+func Format(items []Rule) string {
+	lines := make([]string, len(items))
+	for i := range items {
+		lines[i] = items[i].String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DeviceClass returns a device class of the user agent.
+func DeviceClass(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Windows Phone"):
+		return Other
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "iPod"):
+		return IOS
+	case strings.Contains(userAgent, "Android"):
+		return Android
+	}
+	return Other
+}
+
+// PreferredLanguage returns the most preferred language tag of Accept-Language header in lower case.
+func PreferredLanguage(header string) string {
+	var (
+		result string
+		best   float64
+	)
+	for _, value := range strings.Split(header, ",") {
+		parts := strings.Split(value, ";")
+		tag, weight := strings.ToLower(strings.TrimSpace(parts[0])), 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				w, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					w = 0
+				}
+				weight = w
+			}
+		}
+		if (tag != "") && (tag != "*") && (weight > best) {
+			result, best = tag, weight
+		}
+	}
+	return result
+}
+
+// rulesKey returns db key of link's rules.
+func rulesKey(short string) (string, error) {
+	return conf.DbKey("rules", short)
+}
+
+// Get returns link's rules.
+func Get(c redis.Conn, short string) ([]Rule, error) {
+	key, err := rulesKey(short)
+	if err != nil {
+		return nil, err
+	}
+	value, err := redis.Bytes(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []Rule
+	if err = json.Unmarshal(value, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Targets returns target URLs of link's rules.
+func Targets(c redis.Conn, short string) ([]string, error) {
+	items, err := Get(c, short)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(items))
+	for i := range items {
+		result[i] = items[i].Target
+	}
+	return result, nil
+}
+
+// Set validates and saves link's rules, empty list removes them.
+func Set(c redis.Conn, cfg *conf.Cfg, short string, items []Rule) error {
+	if len(items) > cfg.Rules.Max {
+		return fmt.Errorf("too many rules, maximum is %d", cfg.Rules.Max)
+	}
+	for i := range items {
+		if err := items[i].isValid(cfg); err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+	}
+	key, err := rulesKey(short)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		_, err = c.Do("DEL", key)
+		return err
+	}
+	value, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SET", key, value)
+	return err
+}
+
+// Target returns a target of the first link's rule matching the request
+// and a flag that the link has rules, so the redirect depends on the client.
+// It returns empty string if the link has not matched rules.
+func Target(c redis.Conn, cfg *conf.Cfg, short string, r *http.Request) (string, bool, error) {
+	items, err := Get(c, short)
+	if err != nil {
+		return "", false, err
+	}
+	if len(items) == 0 {
+		return "", false, nil
+	}
+	t := now().UTC()
+	cl := &client{
+		device:   DeviceClass(r.UserAgent()),
+		language: PreferredLanguage(r.Header.Get("Accept-Language")),
+		minute:   t.Hour()*60 + t.Minute(),
+	}
+	if ip := privacy.ClientIP(cfg, r); ip != nil {
+		cl.country = Country(ip)
+	}
+	for i := range items {
+		if items[i].match(cl) {
+			return items[i].Target, true, nil
+		}
+	}
+	return "", true, nil
+}
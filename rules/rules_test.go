@@ -0,0 +1,267 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "lruss_geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestParse(t *testing.T) {
+	text := "# app stores\ndevice=ios https://apps.apple.com/app/id1 # iOS\n\n" +
+		"lang=de,fr country=de time=22:00-06:00 https://example.de/\nhttps://example.com/\n" +
+		"  #device=android https://example.com/\ndevice=android https://example.com/app#install\t#install"
+	items, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(items); n != 4 {
+		t.Fatalf("unexpected rules number %d", n)
+	}
+	if (items[0].Device != IOS) || (items[0].Target != "https://apps.apple.com/app/id1") {
+		t.Errorf("unexpected rule %+v", items[0])
+	}
+	if (items[3].Device != Android) || (items[3].Target != "https://example.com/app#install") {
+		t.Errorf("unexpected rule %+v", items[3])
+	}
+	if s := items[1].String(); s != "lang=de,fr country=de time=22:00-06:00 https://example.de/" {
+		t.Errorf("unexpected rule %v", s)
+	}
+	if s := Format(items[1:3]); s != "lang=de,fr country=de time=22:00-06:00 https://example.de/\nhttps://example.com/" {
+		t.Errorf("unexpected rules %v", s)
+	}
+	invalid := []string{
+		"device https://example.com/",
+		"os=ios https://example.com/",
+		"device= https://example.com/",
+	}
+	for i, value := range invalid {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("failed case [%v]: expected error", i)
+		}
+	}
+}
+
+func TestDeviceClass(t *testing.T) {
+	values := map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 11_0 like Mac OS X) AppleWebKit/604.1.38":   IOS,
+		"Mozilla/5.0 (iPad; CPU OS 11_0 like Mac OS X) AppleWebKit/604.1.34":            IOS,
+		"Mozilla/5.0 (Linux; Android 8.0.0; Pixel Build/OPR3.170623.007) Chrome/61.0":   Android,
+		"Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) Edge/15": Other,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:56.0) Gecko/20100101 Firefox/56.0":          Other,
+		"": Other,
+	}
+	for userAgent, expected := range values {
+		if device := DeviceClass(userAgent); device != expected {
+			t.Errorf("failed %q: %v != %v", userAgent, device, expected)
+		}
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	values := map[string]string{
+		"":                              "",
+		"*":                             "",
+		"de-AT":                         "de-at",
+		"en-US,en;q=0.9,de;q=0.8":       "en-us",
+		"fr;q=0.5, pt-BR;q=0.9, en;q=0": "pt-br",
+		"en;q=0, es;q=invalid":          "",
+		"ru;q=0.8,uk":                   "uk",
+	}
+	for header, expected := range values {
+		if language := PreferredLanguage(header); language != expected {
+			t.Errorf("failed %q: %v != %v", header, language, expected)
+		}
+	}
+}
+
+func TestCountry(t *testing.T) {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := writeFile(t, "network,country\n# comment\n192.0.2.0/24,de\n198.51.100.0/25,US,extra\n2001:db8::/32,FR\ninvalid,XX\n")
+	defer os.Remove(name)
+
+	cfg.Rules.GeoIP = name
+	if err = Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cfg.Rules.GeoIP = ""
+		if err := Load(cfg); err != nil {
+			t.Error(err)
+		}
+	}()
+	if n := Size(); n != 3 {
+		t.Errorf("unexpected networks number %d", n)
+	}
+	values := map[string]string{
+		"192.0.2.1":        "DE",
+		"192.0.2.255":      "DE",
+		"192.0.3.0":        "",
+		"198.51.100.127":   "US",
+		"198.51.100.128":   "",
+		"2001:db8::1":      "FR",
+		"2001:db9::1":      "",
+		"10.0.0.1":         "",
+		"::ffff:192.0.2.7": "DE",
+	}
+	for value, expected := range values {
+		if country := Country(net.ParseIP(value)); country != expected {
+			t.Errorf("failed %v: %q != %q", value, country, expected)
+		}
+	}
+	cfg.Rules.GeoIP = "/not/existing/file"
+	if err = Load(cfg); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTarget(t *testing.T) {
+	cfg := initConfig(t)
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	name := writeFile(t, "192.0.2.0/24,DE\n")
+	defer os.Remove(name)
+	cfg.Rules.GeoIP = name
+	if err := Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cfg.Rules.GeoIP = ""
+		if err := Load(cfg); err != nil {
+			t.Error(err)
+		}
+	}()
+	now = func() time.Time {
+		return time.Date(2017, 10, 1, 23, 30, 0, 0, time.UTC)
+	}
+	defer func() { now = time.Now }()
+
+	items, err := Parse("device=ios https://apps.apple.com/app/id1\n" +
+		"device=android https://play.google.com/store/apps/details?id=app\n" +
+		"country=de time=09:00-18:00 https://example.de/day\n" +
+		"country=de time=22:00-06:00 https://example.de/night\n" +
+		"lang=fr https://example.fr/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Set(c, cfg, "1", items); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Get(c, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(saved) != 5) || (saved[2].Countries[0] != "DE") {
+		t.Errorf("unexpected rules %+v", saved)
+	}
+	targets, err := Targets(c, "1")
+	if (err != nil) || (len(targets) != 5) || (targets[4] != "https://example.fr/") {
+		t.Errorf("unexpected targets %v: %v", targets, err)
+	}
+	cases := []struct {
+		userAgent, language, addr, expected string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 11_0 like Mac OS X)", "", "203.0.113.1:1234", "https://apps.apple.com/app/id1"},
+		{"Mozilla/5.0 (Linux; Android 8.0.0)", "de", "192.0.2.1:1234", "https://play.google.com/store/apps/details?id=app"},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "", "192.0.2.1:1234", "https://example.de/night"},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "fr-CA,en;q=0.8", "203.0.113.1:1234", "https://example.fr/"},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "en,fr;q=0.8", "203.0.113.1:1234", ""},
+	}
+	for i, item := range cases {
+		r := httptest.NewRequest("GET", "/1", nil)
+		r.RemoteAddr = item.addr
+		r.Header.Set("User-Agent", item.userAgent)
+		r.Header.Set("Accept-Language", item.language)
+		target, conditional, err := Target(c, cfg, "1", r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !conditional {
+			t.Errorf("failed case [%v]: not conditional", i)
+		}
+		if target != item.expected {
+			t.Errorf("failed case [%v]: %q != %q", i, target, item.expected)
+		}
+	}
+	if target, conditional, err := Target(c, cfg, "2", httptest.NewRequest("GET", "/2", nil)); (err != nil) || (target != "") || conditional {
+		t.Errorf("unexpected result %q, %v: %v", target, conditional, err)
+	}
+	invalid := [][]Rule{
+		{{Device: "windows", Target: "https://example.com/"}},
+		{{Countries: []string{"DEU"}, Target: "https://example.com/"}},
+		{{Time: "09:00", Target: "https://example.com/"}},
+		{{Time: "25:00-26:00", Target: "https://example.com/"}},
+		{{Target: "javascript:alert(1)"}},
+		make([]Rule, cfg.Rules.Max+1),
+	}
+	for i, value := range invalid {
+		if err := Set(c, cfg, "1", value); err == nil {
+			t.Errorf("failed case [%v]: expected error", i)
+		}
+	}
+	if err = Set(c, cfg, "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = Get(c, "1"); (err != nil) || (len(saved) != 0) {
+		t.Errorf("unexpected result %v: %v", saved, err)
+	}
+}
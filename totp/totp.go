@@ -0,0 +1,113 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package totp implements time-based one-time passwords (RFC 6238)
+// with default parameters: HMAC-SHA1, 30 seconds period and 6 digits.
+// All functions get the time as an argument, so they don't depend on system clock.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period is a time step of one-time passwords (seconds).
+	Period = 30
+	// Digits is a number of one-time password digits.
+	Digits = 6
+	// secretLen is length of generated secret (bytes).
+	secretLen = 20
+)
+
+var (
+	// encoding is base32 encoding of secrets without padding.
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	// modulo are divisors to get a number of digits.
+	modulo = map[int]uint32{6: 1e6, 7: 1e7, 8: 1e8}
+)
+
+// NewSecret returns new random base32 encoded secret.
+func NewSecret() (string, error) {
+	b := make([]byte, secretLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// decode returns the secret key bytes.
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// hotp returns HMAC-based one-time password (RFC 4226).
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%modulo[digits])
+}
+
+// Counter returns a number of time step for t.
+func Counter(t time.Time) uint64 {
+	return uint64(t.Unix() / Period)
+}
+
+// Code returns one-time password of the secret for time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, Counter(t), Digits), nil
+}
+
+// Validate checks the code for time t allowing skew time steps before and after it,
+// it returns a counter of matched time step.
+func Validate(secret, code string, t time.Time, skew int) (uint64, bool) {
+	key, err := decode(secret)
+	if err != nil || (len(code) != Digits) {
+		return 0, false
+	}
+	counter := Counter(t)
+	for i := -skew; i <= skew; i++ {
+		c := uint64(int64(counter) + int64(i))
+		if subtle.ConstantTimeCompare([]byte(hotp(key, c, Digits)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns otpauth URI of the secret for authenticator applications.
+func URI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226, appendix D
+	key := []byte("12345678901234567890")
+	expected := []string{"755224", "287082", "359152", "969429", "338314"}
+	for i, code := range expected {
+		if value := hotp(key, uint64(i), 6); value != code {
+			t.Errorf("invalid code for counter %d: %v", i, value)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	// RFC 6238, appendix B, SHA1 mode
+	key := []byte("12345678901234567890")
+	secret := encoding.EncodeToString(key)
+	items := map[int64]string{
+		59:         "94287082",
+		1111111109: "07081804",
+		1111111111: "14050471",
+		1234567890: "89005924",
+		2000000000: "69279037",
+	}
+	for ts, code := range items {
+		tm := time.Unix(ts, 0)
+		if value := hotp(key, Counter(tm), 8); value != code {
+			t.Errorf("invalid code for %v: %v", ts, value)
+		}
+		value, err := Code(secret, tm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != code[2:] {
+			t.Errorf("invalid 6-digits code for %v: %v", ts, value)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	code, err := Code(secret, now.Add(-Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, code, now, 0); ok {
+		t.Error("previous code is valid without skew")
+	}
+	counter, ok := Validate(secret, code, now, 1)
+	if !ok {
+		t.Error("previous code is invalid with skew")
+	}
+	if counter != Counter(now)-1 {
+		t.Errorf("invalid counter %v", counter)
+	}
+	if _, ok := Validate(secret, "abc", now, 1); ok {
+		t.Error("bad code is valid")
+	}
+	if _, ok := Validate("!!!", code, now, 1); ok {
+		t.Error("code of bad secret is valid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("LRUSS", "admin", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/LRUSS:admin?") || !strings.Contains(uri, "secret=ABC") {
+		t.Errorf("invalid URI %v", uri)
+	}
+}
@@ -12,14 +12,29 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"net"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/abuse"
+	"github.com/z0rr0/lruss/admin"
+	"github.com/z0rr0/lruss/analytics"
+	"github.com/z0rr0/lruss/apikey"
+	"github.com/z0rr0/lruss/audit"
 	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+	"github.com/z0rr0/lruss/metrics"
+	"github.com/z0rr0/lruss/policy"
+	"github.com/z0rr0/lruss/privacy"
+	"github.com/z0rr0/lruss/ratelimit"
+	"github.com/z0rr0/lruss/rules"
 	"github.com/z0rr0/lruss/trim"
+	"github.com/z0rr0/lruss/webhook"
 )
 
 const (
@@ -29,40 +44,45 @@ const (
 
 type key string
 
+var (
+	// LoggerError logs failed side effects of handlers which don't break responses,
+	// main package replaces it by own logger.
+	LoggerError = log.New(os.Stderr, "ERROR [web]: ", log.Ldate|log.Ltime|log.Lshortfile)
+)
+
+// indexPage is index page template data.
+type indexPage struct {
+	Public bool
+}
+
+// reportPage is abuse report page template data.
+type reportPage struct {
+	CSRF    string
+	Short   string
+	Reasons []string
+	Msg     string
+	Error   string
+}
+
+// leavingPage is "You are leaving" page template data.
+type leavingPage struct {
+	*link.Link
+	Reported bool
+	Target   template.URL
+}
+
 // Response is API response for URL shorting.
 type Response struct {
 	URL   string `json:"url"`
 	Short string `json:"short"`
 }
 
-// allowedRate checks minute's rate for host address.
-func allowedRate(r *http.Request, c redis.Conn, cfg *conf.Cfg) (bool, error) {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return false, err
-	}
-	if cfg.Rate.CheckUserAgent {
-		host = fmt.Sprintf("%v:ua:%v", host, r.UserAgent())
-	}
-	hostKey, err := conf.DbKey("host", host)
-	if err != nil {
-		return false, err
-	}
-	hostRate, err := redis.Int64(c.Do("INCR", hostKey))
-	if err != nil {
-		return false, err
-	}
-	if hostRate == 1 {
-		_, err = c.Do("EXPIRE", hostKey, cfg.Rate.Interval)
-		if err != nil {
-			return false, err
-		}
-		return true, nil
-	}
-	if hostRate < cfg.Rate.Count {
-		return true, nil
-	}
-	return false, nil
+// RateLimit is API response item of client's rate limit state.
+// Reset is a number of seconds until the limit is fully restored.
+type RateLimit struct {
+	Limit     int64 `json:"limit"`
+	Remaining int64 `json:"remaining"`
+	Reset     int64 `json:"reset"`
 }
 
 // ResetTplCache resets template cache.
@@ -92,6 +112,15 @@ func SetContext(ctx context.Context, path string) context.Context {
 	return context.WithValue(ctx, pathKey, path)
 }
 
+// ShortCode returns short code part of the request path without leading slash,
+// other segments can be passed to destination URL.
+func ShortCode(path string) string {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
 // GetContext reads path from context.
 func GetContext(ctx context.Context) (string, error) {
 	c, ok := ctx.Value(pathKey).(string)
@@ -107,30 +136,83 @@ func HandleAPI(ctx context.Context, w http.ResponseWriter, r *http.Request) (int
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	originURL := r.FormValue("url")
-	if originURL == "" {
-		return http.StatusBadRequest, errors.New("not url")
-	}
-	u, err := url.Parse(originURL)
+	u, err := policy.Check(cfg, r.FormValue("url"))
 	if err != nil {
-		return http.StatusBadRequest, errors.New("invalid url")
+		return http.StatusBadRequest, err
 	}
-	if !u.IsAbs() {
-		return http.StatusBadRequest, errors.New("not absolute url")
+	utm := link.UTM{
+		Source:   strings.TrimSpace(r.FormValue("utm_source")),
+		Medium:   strings.TrimSpace(r.FormValue("utm_medium")),
+		Campaign: strings.TrimSpace(r.FormValue("utm_campaign")),
+		Term:     strings.TrimSpace(r.FormValue("utm_term")),
+		Content:  strings.TrimSpace(r.FormValue("utm_content")),
+	}
+	if err = utm.Validate(); err != nil {
+		return http.StatusBadRequest, err
 	}
 
 	c := cfg.GetConn()
 	defer c.Close()
 
-	if cfg.Rate.Active {
-		allowed, err := allowedRate(r, c, cfg)
+	apiKey, err := apikey.FromRequest(c, r)
+	if err != nil {
+		if err == apikey.ErrInvalid {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return conf.HTTPError(http.StatusUnauthorized)
+		}
+		return http.StatusInternalServerError, err
+	}
+	switch {
+	case apiKey != nil:
+		result, err := apikey.Allowed(c, apiKey, cfg.API.KeyWindow())
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
-		if !allowed {
+		if result != nil {
+			ratelimit.SetHeaders(w, result)
+			if !result.Allowed {
+				metrics.RateRejections.Inc()
+				return conf.HTTPError(http.StatusTooManyRequests)
+			}
+		}
+	case cfg.API.RequireKey:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return conf.HTTPError(http.StatusUnauthorized)
+	case cfg.Rate.Active:
+		result, err := ratelimit.Check(c, cfg, ratelimit.API, r)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		ratelimit.SetHeaders(w, result)
+		if !result.Allowed {
+			metrics.RateRejections.Inc()
 			return conf.HTTPError(http.StatusTooManyRequests)
 		}
 	}
+	var owner string
+	if apiKey != nil {
+		owner = link.KeyOwner(apiKey.Name)
+	} else if username := admin.GetContext(ctx); username != admin.Anonymous {
+		owner = link.UserOwner(username)
+	}
+	// the same owner's destination with the same campaign returns existing short link
+	existing, err := link.Find(c, owner, u.String(), &utm)
+	switch {
+	case err == nil:
+		return writeJSON(w, &Response{URL: existing.URL, Short: cfg.ShortURL(existing.Short)})
+	case err != link.ErrNotFound:
+		return http.StatusInternalServerError, err
+	}
+	if apiKey != nil {
+		// only new links use API key quota
+		allowed, err := apikey.Use(c, apiKey)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !allowed {
+			return http.StatusForbidden, errors.New("API key quota is exceeded")
+		}
+	}
 	countKey, err := conf.DbKey("count", "count")
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -142,13 +224,176 @@ func HandleAPI(ctx context.Context, w http.ResponseWriter, r *http.Request) (int
 	short := trim.Encode(num)
 	response := &Response{URL: u.String(), Short: cfg.ShortURL(short)}
 
-	urlKey, err := conf.DbKey("url", short)
+	l := &link.Link{Short: short, URL: response.URL, Owner: owner, Created: time.Now().UTC(), UTM: utm}
+	err = link.Save(c, l)
+	if err != nil {
+		return conf.HTTPError(http.StatusServiceUnavailable)
+	}
+	if apiKey != nil {
+		audit.SetActor(ctx, l.Owner)
+	}
+	if l.Owner != "" {
+		// only authenticated requests are registered
+		audit.Annotate(ctx, "link.create", short)
+	}
+	metrics.Links.Inc()
+	// the link is already saved, statistics and notification errors don't fail the request
+	if err = analytics.Created(c, cfg); err != nil {
+		LoggerError.Printf("analytics error: %v", err)
+	}
+	if err = webhook.Notify(c, cfg, webhook.Created, short, response.URL); err != nil {
+		LoggerError.Printf("webhook error: %v", err)
+	}
+	return writeJSON(w, response)
+}
+
+// writeJSON writes API response.
+func writeJSON(w http.ResponseWriter, response *Response) (int, error) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// requestOwner returns links owner name of request's API key or authenticated user.
+func requestOwner(ctx context.Context, c redis.Conn, r *http.Request) (string, error) {
+	apiKey, err := apikey.FromRequest(c, r)
+	if err != nil {
+		return "", err
+	}
+	if apiKey != nil {
+		owner := link.KeyOwner(apiKey.Name)
+		audit.SetActor(ctx, owner)
+		return owner, nil
+	}
+	if username := admin.GetContext(ctx); username != admin.Anonymous {
+		return link.UserOwner(username), nil
+	}
+	return "", apikey.ErrInvalid
+}
+
+// HandleLinks returns JSON list of own links, parameter "q" is a search query.
+func HandleLinks(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	owner, err := requestOwner(ctx, c, r)
 	if err != nil {
+		if err == apikey.ErrInvalid {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return conf.HTTPError(http.StatusUnauthorized)
+		}
 		return http.StatusInternalServerError, err
 	}
-	_, err = c.Do("SET", urlKey, response.URL)
+	audit.Annotate(ctx, "link.list", owner)
+	items, err := link.List(c, owner, r.FormValue("q"))
 	if err != nil {
-		return conf.HTTPError(http.StatusServiceUnavailable)
+		return http.StatusInternalServerError, err
+	}
+	response := make([]Response, len(items))
+	for i, item := range items {
+		response[i] = Response{URL: item.URL, Short: cfg.ShortURL(item.Short)}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// HandleDelete removes own link with short code from parameter "short".
+func HandleDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	owner, err := requestOwner(ctx, c, r)
+	if err != nil {
+		if err == apikey.ErrInvalid {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return conf.HTTPError(http.StatusUnauthorized)
+		}
+		return http.StatusInternalServerError, err
+	}
+	short := r.FormValue("short")
+	audit.Annotate(ctx, "link.delete", short)
+	if !trim.IsShort(short) {
+		return http.StatusBadRequest, errors.New("invalid short link")
+	}
+	l, err := link.Get(c, short)
+	if err == link.ErrNotFound {
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if l.Owner != owner {
+		return conf.HTTPError(http.StatusForbidden)
+	}
+	err = link.Delete(c, l)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// HandleRateLimit returns current rate limits state of the client for all limited routes,
+// "key" item is a limit of the API key from the request.
+func HandleRateLimit(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	apiKey, err := apikey.FromRequest(c, r)
+	if err != nil {
+		if err == apikey.ErrInvalid {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return conf.HTTPError(http.StatusUnauthorized)
+		}
+		return http.StatusInternalServerError, err
+	}
+	results := make(map[string]*ratelimit.Result)
+	if apiKey != nil {
+		result, err := apikey.RateStatus(c, apiKey, cfg.API.KeyWindow())
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		results["key"] = result
+	}
+	routes := []string{ratelimit.API}
+	for route := range cfg.Rate.Routes {
+		routes = append(routes, route)
+	}
+	for _, route := range routes {
+		result, err := ratelimit.Status(c, cfg, route, r)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		results[route] = result
+	}
+	response := make(map[string]RateLimit, len(results))
+	for route, result := range results {
+		if result != nil {
+			response[route] = RateLimit{
+				Limit:     result.Limit,
+				Remaining: result.Remaining,
+				Reset:     int64((result.Reset + time.Second - 1) / time.Second),
+			}
+		}
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	encoder := json.NewEncoder(w)
@@ -171,25 +416,275 @@ func HandleRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	c := cfg.GetConn()
 	defer c.Close()
 
-	urlKey, err := conf.DbKey("url", short)
+	l, err := link.Get(c, short)
+	if err != nil {
+		if err != link.ErrNotFound {
+			return conf.HTTPError(http.StatusServiceUnavailable)
+		}
+		metrics.Redirects.Inc("miss")
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	if l.Disabled != "" {
+		metrics.Redirects.Inc("disabled")
+		return render(cfg, w, "warning.html", http.StatusGone, l)
+	}
+	conditional := false
+	if cfg.Rules.Active {
+		var target string
+		target, conditional, err = rules.Target(c, cfg, short, r)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if target != "" {
+			l.URL = target
+		}
+	}
+	l.URL, err = destination(l, r)
+	if err != nil {
+		metrics.Redirects.Inc("miss")
+		return conf.HTTPError(http.StatusNotFound)
+	}
+	reported, err := abuse.Reported(c, short)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	originURL, err := redis.String(c.Do("GET", urlKey))
+	if reported || interstitial(cfg, l) {
+		// the user can leave the page, so it's not a click
+		metrics.Redirects.Inc("interstitial")
+		page := &leavingPage{Link: l, Reported: reported, Target: leavingTarget(cfg, l.URL)}
+		return render(cfg, w, "leaving.html", http.StatusOK, page)
+	}
+	metrics.Redirects.Inc("hit")
+	// statistics and notification errors don't prevent the redirect
+	if err = analytics.Click(c, cfg, short, r); err != nil {
+		LoggerError.Printf("analytics error: %v", err)
+	}
+	if err = analytics.Campaign(c, cfg, l.UTM.Campaign); err != nil {
+		LoggerError.Printf("analytics error: %v", err)
+	}
+	if err = webhook.Notify(c, cfg, webhook.Clicked, short, l.URL); err != nil {
+		LoggerError.Printf("webhook error: %v", err)
+	}
+	code := redirectHeaders(cfg, w, l, conditional)
+	http.Redirect(w, r, l.URL, code)
+	return code, nil
+}
+
+// redirectHeaders sets Referrer-Policy and cache headers of the link's redirect
+// and returns its status code. Only permanent redirects are cached,
+// conditional redirects (by link's rules) are never cached because they depend on
+// client's device, language, country and current time.
+func redirectHeaders(cfg *conf.Cfg, w http.ResponseWriter, l *link.Link, conditional bool) int {
+	code, referrer := cfg.Redirect.Status, cfg.Redirect.ReferrerPolicy
+	if l.Status != 0 {
+		code = l.Status
+	}
+	if l.ReferrerPolicy != "" {
+		referrer = l.ReferrerPolicy
+	}
+	if referrer != "" {
+		w.Header().Set("Referrer-Policy", referrer)
+	}
+	switch {
+	case conditional:
+		w.Header().Set("Cache-Control", "no-store")
+	case conf.IsPermanentRedirect(code) && (cfg.Redirect.MaxAge > 0):
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.Redirect.MaxAge))
+		expires := time.Now().Add(time.Duration(cfg.Redirect.MaxAge) * time.Second)
+		w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+	return code
+}
+
+// destination returns redirect URL of the link with request's query parameters
+// and path after short code if they are passed by link's options.
+// Parameters which already are in destination URL are not changed,
+// link's campaign parameters are always appended.
+func destination(l *link.Link, r *http.Request) (string, error) {
+	suffix := strings.TrimPrefix(strings.TrimLeft(r.URL.EscapedPath(), "/"), l.Short)
+	if !l.PassPath {
+		if strings.Trim(suffix, "/") != "" {
+			return "", errors.New("not passed path")
+		}
+		suffix = ""
+	}
+	passQuery := l.PassQuery && (r.URL.RawQuery != "")
+	if (suffix == "") && !passQuery && l.UTM.IsZero() {
+		return l.URL, nil
+	}
+	u, err := url.Parse(l.URL)
 	if err != nil {
-		if err != redis.ErrNil {
-			return conf.HTTPError(http.StatusServiceUnavailable)
+		return "", err
+	}
+	if suffix != "" {
+		path := strings.TrimSuffix(u.EscapedPath(), "/") + suffix
+		if u.Path, err = url.PathUnescape(path); err != nil {
+			return "", err
+		}
+		u.RawPath = path
+	}
+	if passQuery {
+		existing := u.Query()
+		params := []string{}
+		if u.RawQuery != "" {
+			params = append(params, u.RawQuery)
+		}
+		for _, param := range strings.Split(r.URL.RawQuery, "&") {
+			name, err := paramName(param)
+			if (err != nil) || (name == "") {
+				continue
+			}
+			if _, ok := existing[name]; !ok {
+				params = append(params, param)
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	if !l.UTM.IsZero() {
+		// campaign parameters replace the same ones of destination and request
+		tags := l.UTM.Values()
+		params := []string{}
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			name, err := paramName(param)
+			if err != nil {
+				continue
+			}
+			if _, ok := tags[name]; !ok && (param != "") {
+				params = append(params, param)
+			}
 		}
+		u.RawQuery = strings.Join(append(params, tags.Encode()), "&")
+	}
+	return u.String(), nil
+}
+
+// paramName returns unescaped name of the query parameter.
+func paramName(param string) (string, error) {
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		param = param[:i]
+	}
+	return url.QueryUnescape(param)
+}
+
+// interstitial checks "You are leaving" page should be shown instead of redirect.
+// Link's mode has priority, otherwise the page is shown for not trusted domains if it's active.
+func interstitial(cfg *conf.Cfg, l *link.Link) bool {
+	switch l.Interstitial {
+	case link.InterstitialOn:
+		return true
+	case link.InterstitialOff:
+		return false
+	}
+	if !cfg.Interstitial.Active {
+		return false
+	}
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return true
+	}
+	return !policy.Trusted(cfg, u)
+}
+
+// leavingTarget returns destination URL for the link of "You are leaving" page.
+// It is empty if the URL's scheme isn't allowed by the policy.
+func leavingTarget(cfg *conf.Cfg, rawURL string) template.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	scheme := strings.ToLower(u.Scheme)
+	for _, s := range cfg.Policy.Schemes {
+		if s == scheme {
+			// the scheme is checked, so the URL can be used as is
+			return template.URL(rawURL)
+		}
+	}
+	return ""
+}
+
+// render returns a page of the link with a status code instead of redirect.
+func render(cfg *conf.Cfg, w http.ResponseWriter, name string, code int, data interface{}) (int, error) {
+	var buffer bytes.Buffer
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, name),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(&buffer, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	_, err = buffer.WriteTo(w)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return code, nil
+}
+
+// HandleReport returns abuse report form of a short link from "short" parameter,
+// POST request saves new report.
+func HandleReport(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	cfg, err := conf.GetContext(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !cfg.Reports.Active {
 		return conf.HTTPError(http.StatusNotFound)
 	}
-	http.Redirect(w, r, originURL, http.StatusFound)
-	return http.StatusFound, nil
+	csrfValue, err := admin.GetCSRF(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data := &reportPage{CSRF: csrfValue, Short: r.FormValue("short"), Reasons: abuse.Reasons}
+	if !trim.IsShort(data.Short) {
+		return http.StatusBadRequest, errors.New("invalid short link")
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	if r.Method == "POST" {
+		// csrf is already checked
+		ip := privacy.ClientIP(cfg, r)
+		if ip == nil {
+			return http.StatusBadRequest, errors.New("unknown client")
+		}
+		client, err := privacy.ClientID(c, cfg, ip.String(), r.UserAgent())
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		report := &abuse.Report{Reason: r.PostFormValue("reason"), Comment: r.PostFormValue("comment")}
+		_, err = abuse.Add(c, cfg, data.Short, client, report)
+		switch {
+		case err == link.ErrNotFound:
+			return conf.HTTPError(http.StatusNotFound)
+		case err != nil:
+			data.Error = err.Error()
+		default:
+			// repeated reports get the same answer
+			data.Msg = "Thank you, the report is sent to moderators."
+		}
+	}
+	tpl, err := template.ParseFiles(
+		filepath.Join(cfg.Static, "base.html"),
+		filepath.Join(cfg.Static, "report.html"),
+	)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
 }
 
 // HandleHTML returns an index HTML page.
 func HandleHTML(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
 	var (
-		data   interface{}
 		tpl    *template.Template
 		buffer bytes.Buffer
 	)
@@ -197,6 +692,7 @@ func HandleHTML(ctx context.Context, w http.ResponseWriter, r *http.Request) (in
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	data := &indexPage{Public: !cfg.API.RequireKey}
 	c := cfg.GetConn()
 	defer c.Close()
 
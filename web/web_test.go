@@ -0,0 +1,111 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/z0rr0/lruss/conf"
+	"github.com/z0rr0/lruss/link"
+)
+
+func TestShortCode(t *testing.T) {
+	values := map[string]string{"": "", "abc": "abc", "abc/": "abc", "abc/d/e": "abc"}
+	for path, expected := range values {
+		if short := ShortCode(path); short != expected {
+			t.Errorf("failed %q: %v != %v", path, short, expected)
+		}
+	}
+}
+
+func TestDestination(t *testing.T) {
+	cases := []struct {
+		target    string
+		passQuery bool
+		passPath  bool
+		request   string
+		expected  string
+		fail      bool
+	}{
+		// without passthrough
+		{"https://example.com/docs", false, false, "/abc", "https://example.com/docs", false},
+		{"https://example.com/docs", false, false, "/abc/", "https://example.com/docs", false},
+		{"https://example.com/docs", false, false, "/abc?ref=mail", "https://example.com/docs", false},
+		{"https://example.com/docs", false, false, "/abc/guide", "", true},
+		{"https://example.com/docs", true, false, "/abc/guide?ref=mail", "", true},
+		// query parameters
+		{"https://example.com/", true, false, "/abc?ref=mail", "https://example.com/?ref=mail", false},
+		{"https://example.com/?lang=en", true, false, "/abc?lang=ru&ref=mail", "https://example.com/?lang=en&ref=mail", false},
+		{"https://example.com/?lang=en", true, false, "/abc?ref=a&ref=b&=x", "https://example.com/?lang=en&ref=a&ref=b", false},
+		{"https://example.com/?lang=en", true, false, "/abc", "https://example.com/?lang=en", false},
+		// path
+		{"https://example.com/docs", false, true, "/abc/guide/install", "https://example.com/docs/guide/install", false},
+		{"https://example.com/docs/", false, true, "/abc/guide/", "https://example.com/docs/guide/", false},
+		{"https://example.com", false, true, "/abc/guide", "https://example.com/guide", false},
+		{"https://example.com/a%2Fb", false, true, "/abc/c%20d", "https://example.com/a%2Fb/c%20d", false},
+		{"https://example.com/docs?lang=en", true, true, "/abc/guide?ref=mail&lang=ru", "https://example.com/docs/guide?lang=en&ref=mail", false},
+	}
+	for i, c := range cases {
+		l := &link.Link{Short: "abc", URL: c.target, Options: link.Options{PassQuery: c.passQuery, PassPath: c.passPath}}
+		value, err := destination(l, httptest.NewRequest("GET", c.request, nil))
+		if c.fail {
+			if err == nil {
+				t.Errorf("failed case [%v]: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed case [%v]: %v", i, err)
+		} else if value != c.expected {
+			t.Errorf("failed case [%v]: %v != %v", i, value, c.expected)
+		}
+	}
+}
+
+func TestLeavingTarget(t *testing.T) {
+	cfg := &conf.Cfg{}
+	cfg.Policy.Schemes = []string{"http", "https", "mailto", "tel"}
+	values := map[string]string{
+		"https://example.com/a?b=c": "https://example.com/a?b=c",
+		"tel:+15550100":             "tel:+15550100",
+		"mailto:user@example.com":   "mailto:user@example.com",
+		"ftp://example.com/file":    "",
+		"javascript:alert(1)":       "",
+		"%":                         "",
+	}
+	for value, expected := range values {
+		if target := leavingTarget(cfg, value); string(target) != expected {
+			t.Errorf("failed %q: %v != %v", value, target, expected)
+		}
+	}
+}
+
+func TestRedirectHeaders(t *testing.T) {
+	cfg := &conf.Cfg{}
+	cfg.Redirect.Status, cfg.Redirect.MaxAge = 301, 3600
+	cases := []struct {
+		status      int
+		conditional bool
+		expected    string
+	}{
+		{0, false, "public, max-age=3600"},
+		{302, false, ""},
+		{0, true, "no-store"},
+		{302, true, "no-store"},
+	}
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		l := &link.Link{Short: "abc", URL: "https://example.com/", Options: link.Options{Status: c.status}}
+		redirectHeaders(cfg, w, l, c.conditional)
+		if value := w.Header().Get("Cache-Control"); value != c.expected {
+			t.Errorf("failed case [%v]: %q != %q", i, value, c.expected)
+		}
+		if expires := w.Header().Get("Expires"); (expires != "") != strings.HasPrefix(c.expected, "public") {
+			t.Errorf("failed case [%v]: unexpected expires %q", i, expires)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+// Package webhook implements notifications of external services about links events.
+// Events are queued in the storage and delivered by a background worker,
+// failed deliveries are retried with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	// Created is an event of new short link creation.
+	Created = "created"
+	// Clicked is an event of short link redirect.
+	Clicked = "clicked"
+
+	// SignatureHeader is HTTP header name of payload HMAC-SHA256 signature.
+	SignatureHeader = "X-LRUSS-Signature"
+	// EventHeader is HTTP header name of event type.
+	EventHeader = "X-LRUSS-Event"
+	// DeliveryHeader is HTTP header name of delivery identifier.
+	DeliveryHeader = "X-LRUSS-Delivery"
+
+	// idLen is length of event identifier (bytes).
+	idLen = 16
+	// logSize is maximum number of saved delivery results.
+	logSize = 100
+	// deadSize is maximum number of saved failed deliveries.
+	deadSize = 1000
+	// waitTimeout is queue waiting timeout (seconds).
+	waitTimeout = 1
+)
+
+// Event is a notification payload.
+type Event struct {
+	ID    string    `json:"id"`
+	Type  string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Short string    `json:"short"`
+	URL   string    `json:"url"`
+}
+
+// delivery is a queued event for one subscriber.
+type delivery struct {
+	Target  string `json:"target"`
+	Attempt int    `json:"attempt"`
+	Event   Event  `json:"payload"`
+}
+
+// Status is a delivery attempt result.
+type Status struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"event"`
+	Target  string    `json:"target"`
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	Code    int       `json:"code"`
+	Error   string    `json:"error"`
+}
+
+// dbKey returns db key of webhooks queue, log or dead-letter list.
+func dbKey(name string) (string, error) {
+	return conf.DbKey("hook", name)
+}
+
+// newID returns new random event identifier.
+func newID() (string, error) {
+	b := make([]byte, idLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns HMAC-SHA256 signature of payload.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// push adds a delivery to the queue.
+func push(c redis.Conn, d *delivery) error {
+	queueKey, err := dbKey("queue")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("LPUSH", queueKey, b)
+	return err
+}
+
+// Notify queues an event for all its subscribers.
+func Notify(c redis.Conn, cfg *conf.Cfg, event, short, originURL string) error {
+	if !cfg.Webhooks.Active {
+		return nil
+	}
+	targets := cfg.Webhooks.Subscribers(event)
+	if len(targets) == 0 {
+		return nil
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	e := Event{ID: id, Type: event, Time: time.Now().UTC(), Short: cfg.ShortURL(short), URL: originURL}
+	for _, target := range targets {
+		err = push(c, &delivery{Target: target, Event: e})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send posts signed event to the subscriber.
+func send(client *http.Client, secret string, d *delivery) (int, error) {
+	payload, err := json.Marshal(d.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", d.Target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set(EventHeader, d.Event.Type)
+	req.Header.Set(DeliveryHeader, d.Event.ID)
+	req.Header.Set(SignatureHeader, Sign(secret, payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode < http.StatusOK) || (resp.StatusCode >= http.StatusMultipleChoices) {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// save adds a delivery result to the capped list.
+func save(c redis.Conn, name string, size int, value interface{}) error {
+	listKey, err := dbKey(name)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("LPUSH", listKey, b)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("LTRIM", listKey, 0, size-1)
+	return err
+}
+
+// handle delivers the event and schedules a retry if it's failed.
+func handle(c redis.Conn, cfg *conf.Cfg, client *http.Client, d *delivery) error {
+	var code int
+	d.Attempt++
+	secret, ok := cfg.Webhooks.Secret(d.Target)
+	err := fmt.Errorf("subscriber %v is not configured", d.Target)
+	if ok {
+		code, err = send(client, secret, d)
+	}
+	status := Status{
+		ID:      d.Event.ID,
+		Type:    d.Event.Type,
+		Target:  d.Target,
+		Attempt: d.Attempt,
+		Time:    time.Now().UTC(),
+		Code:    code,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if e := save(c, "log", logSize, status); e != nil {
+		return e
+	}
+	switch {
+	case err == nil:
+		return nil
+	case !ok || (d.Attempt > cfg.Webhooks.Retries):
+		return save(c, "dead", deadSize, d)
+	}
+	retryKey, err := dbKey("retry")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	next := time.Now().Add(cfg.Webhooks.RetryDelay(d.Attempt))
+	_, err = c.Do("ZADD", retryKey, next.Unix(), b)
+	return err
+}
+
+// schedule moves deliveries which retry time has come to the queue.
+func schedule(c redis.Conn) error {
+	retryKey, err := dbKey("retry")
+	if err != nil {
+		return err
+	}
+	queueKey, err := dbKey("queue")
+	if err != nil {
+		return err
+	}
+	items, err := redis.Strings(c.Do("ZRANGEBYSCORE", retryKey, "-inf", time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		// only one worker can remove the item
+		n, err := redis.Int(c.Do("ZREM", retryKey, item))
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			_, err = c.Do("LPUSH", queueKey, item)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// next waits and handles one queued delivery.
+func next(c redis.Conn, cfg *conf.Cfg, client *http.Client) error {
+	queueKey, err := dbKey("queue")
+	if err != nil {
+		return err
+	}
+	values, err := redis.Strings(c.Do("BRPOP", queueKey, waitTimeout))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d := &delivery{}
+	err = json.Unmarshal([]byte(values[1]), d)
+	if err != nil {
+		return err
+	}
+	return handle(c, cfg, client, d)
+}
+
+// Run starts delivery worker, it stops when ctx is done.
+func Run(ctx context.Context, cfg *conf.Cfg, logger *log.Logger) {
+	client := &http.Client{Timeout: cfg.Webhooks.RequestTimeout()}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		c := cfg.GetConn()
+		err := schedule(c)
+		if err == nil {
+			err = next(c, cfg, client)
+		}
+		c.Close()
+		if err != nil {
+			logger.Printf("webhook error: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// Deliveries returns last delivery results.
+func Deliveries(c redis.Conn) ([]Status, error) {
+	logKey, err := dbKey("log")
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.ByteSlices(c.Do("LRANGE", logKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Status, len(values))
+	for i, value := range values {
+		err = json.Unmarshal(value, &result[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Dead returns a number of failed deliveries.
+func Dead(c redis.Conn) (int, error) {
+	deadKey, err := dbKey("dead")
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(c.Do("LLEN", deadKey))
+}
+
+// Requeue moves all failed deliveries back to the queue.
+func Requeue(c redis.Conn) (int, error) {
+	deadKey, err := dbKey("dead")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		value, err := redis.Bytes(c.Do("RPOP", deadKey))
+		if err == redis.ErrNil {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		d := &delivery{}
+		err = json.Unmarshal(value, d)
+		if err != nil {
+			return n, err
+		}
+		d.Attempt = 0
+		err = push(c, d)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Alexander Zaytsev <thebestzorro@yandex.ru>.
+// All rights reserved. Use of this source code is governed
+// by a BSD-style license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/z0rr0/lruss/conf"
+)
+
+const (
+	programRepo    = "github.com/z0rr0/lruss"
+	testConfigName = "config.example.json"
+)
+
+func getConfig() string {
+	dirs := []string{os.Getenv("GOPATH"), "src"}
+	dirs = append(dirs, strings.Split(programRepo, "/")...)
+	dirs = append(dirs, testConfigName)
+	return path.Join(dirs...)
+}
+
+func initConfig(t *testing.T) *conf.Cfg {
+	cfg, err := conf.New(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Db = 0
+	cfg.Webhooks.Active = true
+	err = cfg.SetRedisPool()
+	if err != nil {
+		t.Fatalf("set redis pool error: %v", err)
+	}
+	c := cfg.GetConn()
+	defer c.Close()
+
+	_, err = c.Do("FLUSHDB")
+	if err != nil {
+		t.Fatalf("flushdb error: %v", err)
+	}
+	return cfg
+}
+
+func TestSign(t *testing.T) {
+	expected := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if s := Sign("key", []byte("The quick brown fox jumps over the lazy dog")); s != expected {
+		t.Errorf("unexpected signature %v", s)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	var (
+		events []Event
+		fail   bool
+	)
+	secret := "secret"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if s := r.Header.Get(SignatureHeader); s != Sign(secret, body) {
+			t.Errorf("invalid signature %v", s)
+		}
+		e := Event{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		events = append(events, e)
+	}))
+	defer server.Close()
+
+	cfg := initConfig(t)
+	cfg.Webhooks.Retries = 1
+	cfg.Webhooks.Subscriptions[0].URL = server.URL
+	cfg.Webhooks.Subscriptions[0].Secret = secret
+	cfg.Webhooks.Subscriptions[0].Events = []string{Created}
+	c := cfg.GetConn()
+	defer c.Close()
+	defer c.Do("FLUSHDB")
+
+	client := server.Client()
+	if err := Notify(c, cfg, Clicked, "1", "https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Notify(c, cfg, Created, "1", "https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := next(c, cfg, client); err != nil {
+		t.Fatal(err)
+	}
+	if (len(events) != 1) || (events[0].Type != Created) || (events[0].Short != cfg.ShortURL("1")) {
+		t.Fatalf("unexpected events %v", events)
+	}
+	// failed delivery is retried and moved to dead-letter list
+	fail = true
+	if err := Notify(c, cfg, Created, "2", "https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := next(c, cfg, client); err != nil {
+		t.Fatal(err)
+	}
+	retryKey, err := dbKey("retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := redis.Strings(c.Do("ZRANGE", retryKey, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("unexpected retry items %v", items)
+	}
+	d := &delivery{}
+	if err := json.Unmarshal([]byte(items[0]), d); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle(c, cfg, client, d); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Dead(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("unexpected dead deliveries number %d", n)
+	}
+	statuses, err := Deliveries(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(statuses) != 3) || (statuses[0].Code != http.StatusServiceUnavailable) || (statuses[0].Attempt != 2) {
+		t.Errorf("unexpected deliveries %v", statuses)
+	}
+	// requeue
+	fail = false
+	if n, err = Requeue(c); (err != nil) || (n != 1) {
+		t.Fatalf("failed requeue %v, %v", n, err)
+	}
+	if err := next(c, cfg, client); err != nil {
+		t.Fatal(err)
+	}
+	if (len(events) != 2) || (events[1].Short != cfg.ShortURL("2")) {
+		t.Errorf("unexpected events %v", events)
+	}
+}